@@ -0,0 +1,106 @@
+package redirector
+
+import (
+	"sort"
+	"strings"
+)
+
+// MapAliases configures the alias keys generated for the download map.
+// An empty name disables the alias.
+type MapAliases struct {
+	// Latest is the name of the alias to the newest image per board, branch and variant,
+	// like "latest" for orangepi5/latest_current_minimal.
+	Latest string `mapstructure:"latest"`
+
+	// Promoted is the name of the alias to the promoted image per board, like "promoted" for orangepi5/promoted.
+	Promoted string `mapstructure:"promoted"`
+}
+
+// MapAlias is a generated alias key of the download map.
+type MapAlias struct {
+	// Key is the alias request path.
+	Key string `json:"key"`
+
+	// Target is the key the alias points to, empty if the alias was not added.
+	Target string `json:"target,omitempty"`
+
+	// Candidates are the keys the alias could point to, the chosen one first.
+	Candidates []string `json:"candidates"`
+
+	// Conflict is true if the alias was not added because the key already exists in the map.
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// addAliases generates the configured alias keys for the images of the map.
+// When several images match an alias, the newest one wins, then the lowest key.
+// Aliases never replace existing keys.
+func (dm *DownloadMap) addAliases(aliases MapAliases) {
+	candidates := make(map[string][]*Image)
+
+	for _, image := range dm.Images {
+		// Only images with a key without extension get aliases
+		if strings.HasSuffix(image.Key, "."+image.Extension) {
+			continue
+		}
+
+		board := image.prefix + image.Board + "/"
+
+		if aliases.Latest != "" {
+			key := board + aliases.Latest + "_" + image.Branch + "_" + image.Variant + image.suffix
+			candidates[key] = append(candidates[key], image)
+		}
+
+		if aliases.Promoted != "" && image.Promoted {
+			key := board + aliases.Promoted + image.suffix
+			candidates[key] = append(candidates[key], image)
+		}
+	}
+
+	keys := make([]string, 0, len(candidates))
+
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		images := candidates[key]
+
+		sort.Slice(images, func(i, j int) bool {
+			if !images[i].Updated.Equal(images[j].Updated) {
+				return images[i].Updated.After(images[j].Updated)
+			}
+
+			return images[i].Key < images[j].Key
+		})
+
+		alias := &MapAlias{
+			Key:        key,
+			Candidates: make([]string, len(images)),
+		}
+
+		for i, image := range images {
+			alias.Candidates[i] = image.Key
+		}
+
+		dm.Aliases = append(dm.Aliases, alias)
+
+		if _, exists := dm.Paths[key]; exists {
+			alias.Conflict = true
+			continue
+		}
+
+		target := images[0].Key
+		alias.Target = target
+
+		dm.Paths[key] = dm.Paths[target]
+		dm.Files[key] = dm.Files[target]
+
+		for _, ext := range extensionFormats {
+			if p, ok := dm.Paths[target+ext]; ok {
+				dm.Paths[key+ext] = p
+			}
+		}
+	}
+}
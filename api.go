@@ -0,0 +1,456 @@
+package redirector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armbian/redirector/util"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSelectSize is the number of servers returned by the select api.
+const defaultSelectSize = 5
+
+// SelectedServer is a ranked server returned by the select api.
+type SelectedServer struct {
+	Host      string    `json:"host"`
+	URL       string    `json:"url"`
+	Distance  float64   `json:"distance"`
+	Weight    int       `json:"weight"`
+	Continent string    `json:"continent"`
+	Country   string    `json:"country"`
+	Protocols []string  `json:"protocols"`
+	IPv6      bool      `json:"ipv6"`
+	Global    bool      `json:"global,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+// SelectResponse is the response of the select api.
+type SelectResponse struct {
+	IP      string           `json:"ip"`
+	Scheme  string           `json:"scheme"`
+	Servers []SelectedServer `json:"servers"`
+}
+
+// selectHandler returns the ranked candidate servers for the requester, using the same filtering as redirects.
+// Query parameters:
+//   - n: the number of servers to return (default 5)
+//   - scheme: the scheme the servers must support, http or https (default: the request scheme)
+//   - path: the path to build the server urls for (default /)
+//   - ipv6: true or false to require IPv6 support (default: based on the client ip)
+//   - ip: the client ip to select for, only allowed for trusted callers with the apiToken
+func (r *Redirector) selectHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if override := query.Get("ip"); override != "" {
+		if !hasBearerToken(req, r.config.APIToken) {
+			http.Error(w, "ip override requires a trusted token", http.StatusUnauthorized)
+			return
+		}
+
+		if ip = net.ParseIP(override); ip == nil {
+			http.Error(w, "Invalid ip", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scheme := query.Get("scheme")
+
+	if scheme == "" {
+		scheme = requestScheme(req)
+	} else if scheme != "http" && scheme != "https" {
+		http.Error(w, "Invalid scheme", http.StatusBadRequest)
+		return
+	}
+
+	ipv6 := isIPv6(ip)
+
+	if v := query.Get("ipv6"); v != "" {
+		if ipv6, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid ipv6 value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	requestPath := query.Get("path")
+
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n := queryInt(req, "n", defaultSelectSize, len(r.servers))
+
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+
+	res := SelectResponse{
+		IP:      ip.String(),
+		Scheme:  scheme,
+		Servers: make([]SelectedServer, len(ranked)),
+	}
+
+	for i, item := range ranked {
+		server := item.Server
+
+		server.mu.RLock()
+		res.Servers[i] = SelectedServer{
+			Host:      server.Host,
+			Distance:  item.Distance,
+			Weight:    item.Weight,
+			Continent: server.Continent,
+			Country:   server.Country,
+			Protocols: append([]string(nil), server.Protocols...),
+			IPv6:      server.IPv6,
+			Global:    server.Global,
+			LastCheck: server.LastCheck,
+		}
+		server.mu.RUnlock()
+
+		res.Servers[i].URL = r.resolve(server, scheme, requestPath, ipv6).URL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	json.NewEncoder(w).Encode(res)
+}
+
+// defaultSpeedTestSize is the number of mirrors returned by the speed test api.
+const defaultSpeedTestSize = 5
+
+// SpeedTestMirror is a mirror to measure in a speed test.
+type SpeedTestMirror struct {
+	Host     string  `json:"host"`
+	URL      string  `json:"url"`
+	Distance float64 `json:"distance"`
+	Country  string  `json:"country"`
+}
+
+// SpeedTestResponse is the response of the speed test api.
+type SpeedTestResponse struct {
+	IP   string `json:"ip"`
+	Path string `json:"path"`
+	Size int64  `json:"size,omitempty"`
+
+	// Feedback is the url results can be posted back to.
+	Feedback string            `json:"feedback"`
+	Mirrors  []SpeedTestMirror `json:"mirrors"`
+}
+
+// speedTestHandler returns the urls of the test object on the requester's top mirrors,
+// ranked with the same filtering as redirects, so clients can measure them and pick one.
+// The number of mirrors can be set with ?n=, and the scheme with ?scheme=.
+func (r *Redirector) speedTestHandler(w http.ResponseWriter, req *http.Request) {
+	if r.config.SpeedTestPath == "" {
+		http.Error(w, "Speed test is not configured", http.StatusNotFound)
+		return
+	}
+
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scheme := req.URL.Query().Get("scheme")
+
+	if scheme != "http" && scheme != "https" {
+		scheme = requestScheme(req)
+	}
+
+	ipv6 := isIPv6(ip)
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n := queryInt(req, "n", defaultSpeedTestSize, len(r.servers))
+
+	res := SpeedTestResponse{
+		IP:       ip.String(),
+		Path:     r.config.SpeedTestPath,
+		Feedback: requestScheme(req) + "://" + req.Host + "/feedback",
+		Mirrors:  make([]SpeedTestMirror, 0, n),
+	}
+
+	if size, err := util.ParseSize(r.config.SpeedTestSize); err == nil && r.config.SpeedTestSize != "" {
+		res.Size = size
+	}
+
+	for _, item := range ranked {
+		if len(res.Mirrors) >= n {
+			break
+		}
+
+		target := r.resolve(item.Server, scheme, r.config.SpeedTestPath, ipv6)
+
+		// Global backends like Github don't mirror the test object
+		if target.External || item.Server.Global {
+			continue
+		}
+
+		res.Mirrors = append(res.Mirrors, SpeedTestMirror{
+			Host:     item.Server.Host,
+			URL:      target.URL,
+			Distance: item.Distance,
+			Country:  item.Server.Country,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	json.NewEncoder(w).Encode(res)
+}
+
+// mirrorsAPIVersion is the schema version of the mirrors api.
+const mirrorsAPIVersion = 1
+
+// Mirror lifecycle states.
+const (
+	MirrorUnchecked  = "unchecked"
+	MirrorOnline     = "online"
+	MirrorOffline    = "offline"
+	MirrorOverBudget = "over_budget"
+)
+
+// MirrorStatus is a snapshot of a server in the mirrors api.
+type MirrorStatus struct {
+	Host          string        `json:"host"`
+	Path          string        `json:"path"`
+	Continent     string        `json:"continent"`
+	Country       string        `json:"country"`
+	Latitude      float64       `json:"latitude"`
+	Longitude     float64       `json:"longitude"`
+	Weight        int           `json:"weight"`
+	Protocols     []string      `json:"protocols"`
+	IPv4          bool          `json:"ipv4"`
+	IPv6          bool          `json:"ipv6"`
+	IPv4Host      string        `json:"ipv4Host,omitempty"`
+	IPv6Host      string        `json:"ipv6Host,omitempty"`
+	Global        bool          `json:"global"`
+	State         string        `json:"state"`
+	Available     bool          `json:"available"`
+	Reason        string        `json:"reason,omitempty"`
+	LastChange    *time.Time    `json:"lastChange,omitempty"`
+	LastCheck     *time.Time    `json:"lastCheck,omitempty"`
+	LastSync      *time.Time    `json:"lastSync,omitempty"`
+	LatencyMs     *int64        `json:"latencyMs,omitempty"`
+	Checks        []CheckResult `json:"checks"`
+	Uptime7d      *float64      `json:"uptime7d,omitempty"`
+	Uptime30d     *float64      `json:"uptime30d,omitempty"`
+	Redirects     uint64        `json:"redirects"`
+	Failures      uint64        `json:"failures"`
+	MonthlyBudget int64         `json:"monthlyBudget,omitempty"`
+	MonthlyUsage  int64         `json:"monthlyUsage,omitempty"`
+}
+
+// MirrorsResponse is the response of the mirrors api.
+type MirrorsResponse struct {
+	Version int            `json:"version"`
+	Mirrors []MirrorStatus `json:"mirrors"`
+}
+
+// newMirrorStatus takes a snapshot of a server under its lock.
+func newMirrorStatus(server *Server, now time.Time) MirrorStatus {
+	overBudget := server.overBudget()
+
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	status := MirrorStatus{
+		Host:          server.Host,
+		Path:          server.Path,
+		Continent:     server.Continent,
+		Country:       server.Country,
+		Latitude:      server.Latitude,
+		Longitude:     server.Longitude,
+		Weight:        server.Weight,
+		Protocols:     append([]string{}, server.Protocols...),
+		IPv4:          !server.IPv4Broken,
+		IPv6:          server.IPv6,
+		IPv4Host:      server.IPv4Host,
+		IPv6Host:      server.IPv6Host,
+		Global:        server.Global,
+		Available:     server.Available,
+		Reason:        server.Reason,
+		Checks:        append([]CheckResult{}, server.CheckResults...),
+		Redirects:     uint64(counterValue(server.Redirects)),
+		Failures:      uint64(counterValue(server.Failures)),
+		MonthlyBudget: server.MonthlyBudget,
+		MonthlyUsage:  server.MonthlyUsage,
+	}
+
+	switch {
+	case server.LastCheck.IsZero():
+		status.State = MirrorUnchecked
+	case !server.Available:
+		status.State = MirrorOffline
+	case overBudget:
+		status.State = MirrorOverBudget
+	default:
+		status.State = MirrorOnline
+	}
+
+	for _, t := range []struct {
+		value time.Time
+		dest  **time.Time
+	}{
+		{server.LastChange, &status.LastChange},
+		{server.LastCheck, &status.LastCheck},
+		{server.LastSync, &status.LastSync},
+	} {
+		if !t.value.IsZero() {
+			v := t.value.UTC()
+			*t.dest = &v
+		}
+	}
+
+	if server.Latency > 0 {
+		latency := server.Latency.Milliseconds()
+		status.LatencyMs = &latency
+	}
+
+	if ratio, ok := server.uptime.ratio(now, 7); ok {
+		status.Uptime7d = &ratio
+	}
+
+	if ratio, ok := server.uptime.ratio(now, 30); ok {
+		status.Uptime30d = &ratio
+	}
+
+	return status
+}
+
+// mirrorFilter matches mirrors against the query parameters of the mirrors api.
+type mirrorFilter struct {
+	continent string
+	country   string
+	protocol  string
+	ipv6      *bool
+	available *bool
+}
+
+// newMirrorFilter parses the filter query parameters.
+func newMirrorFilter(query url.Values) (mirrorFilter, error) {
+	filter := mirrorFilter{
+		continent: query.Get("continent"),
+		country:   query.Get("country"),
+		protocol:  query.Get("protocol"),
+	}
+
+	for key, dest := range map[string]**bool{
+		"ipv6":      &filter.ipv6,
+		"available": &filter.available,
+	} {
+		if v := query.Get(key); v != "" {
+			b, err := strconv.ParseBool(v)
+
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s value", key)
+			}
+
+			*dest = &b
+		}
+	}
+
+	return filter, nil
+}
+
+// match returns true if the mirror matches every set filter. String filters are case-insensitive.
+func (f mirrorFilter) match(status MirrorStatus) bool {
+	if f.continent != "" && !strings.EqualFold(f.continent, status.Continent) {
+		return false
+	}
+
+	if f.country != "" && !strings.EqualFold(f.country, status.Country) {
+		return false
+	}
+
+	if f.protocol != "" && !lo.ContainsBy(status.Protocols, func(p string) bool { return strings.EqualFold(p, f.protocol) }) {
+		return false
+	}
+
+	if f.ipv6 != nil && *f.ipv6 != status.IPv6 {
+		return false
+	}
+
+	if f.available != nil && *f.available != status.Available {
+		return false
+	}
+
+	return true
+}
+
+// mirrorsAPIHandler returns a versioned snapshot of the mirrors, filtered by continent, country, protocol, ipv6 and available.
+// Responses carry an ETag of their content, so pollers can use If-None-Match.
+func (r *Redirector) mirrorsAPIHandler(w http.ResponseWriter, req *http.Request) {
+	filter, err := newMirrorFilter(req.URL.Query())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	res := MirrorsResponse{
+		Version: mirrorsAPIVersion,
+		Mirrors: make([]MirrorStatus, 0, len(r.servers)),
+	}
+
+	for _, server := range r.servers {
+		if status := newMirrorStatus(server, now); filter.match(status) {
+			res.Mirrors = append(res.Mirrors, status)
+		}
+	}
+
+	b, err := json.Marshal(res)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	etag := "\"" + hex.EncodeToString(sum[:16]) + "\""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(b)
+}
@@ -0,0 +1,249 @@
+package redirector
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+)
+
+var _ = Describe("Mirrors API", func() {
+	var r *Redirector
+
+	BeforeEach(func() {
+		checked := time.Now().Add(-time.Minute)
+
+		r = &Redirector{
+			servers: ServerList{
+				{Host: "mirror-a.example.com", Continent: "EU", Country: "DE", Available: true, Protocols: []string{"http", "https"}, IPv6: true, LastCheck: checked, Latency: 120 * time.Millisecond},
+				{Host: "mirror-b.example.com", Continent: "EU", Country: "IT", Protocols: []string{"http"}, LastCheck: checked, Reason: "certificate is expired", CheckResults: []CheckResult{{Name: "TLSCheck", Error: "certificate is expired"}}},
+				{Host: "mirror-c.example.com", Continent: "NA", Country: "US", Available: true, Protocols: []string{"http"}, LastCheck: checked, MonthlyBudget: 100, MonthlyUsage: 100, usagePeriod: time.Now().UTC().Format(usagePeriodFormat)},
+				{Host: "mirror-d.example.com", Continent: "NA", Country: "CA"},
+			},
+		}
+	})
+
+	get := func(url string, header http.Header) (*httptest.ResponseRecorder, MirrorsResponse) {
+		req := httptest.NewRequest("GET", url, nil)
+
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		r.mirrorsAPIHandler(w, req)
+
+		var res MirrorsResponse
+
+		if w.Code == http.StatusOK {
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+		}
+
+		return w, res
+	}
+
+	It("Should report the lifecycle state of mirrors", func() {
+		_, res := get("/api/v1/mirrors", nil)
+
+		Expect(res.Version).To(Equal(mirrorsAPIVersion))
+		Expect(res.Mirrors).To(HaveLen(4))
+		Expect(res.Mirrors[0].State).To(Equal(MirrorOnline))
+		Expect(*res.Mirrors[0].LatencyMs).To(Equal(int64(120)))
+		Expect(res.Mirrors[1].State).To(Equal(MirrorOffline))
+		Expect(res.Mirrors[1].Checks).To(Equal([]CheckResult{{Name: "TLSCheck", Error: "certificate is expired"}}))
+		Expect(res.Mirrors[2].State).To(Equal(MirrorOverBudget))
+		Expect(res.Mirrors[3].State).To(Equal(MirrorUnchecked))
+		Expect(res.Mirrors[3].LastCheck).To(BeNil())
+	})
+
+	It("Should filter mirrors", func() {
+		_, res := get("/api/v1/mirrors?continent=eu&protocol=HTTPS&ipv6=true", nil)
+
+		Expect(res.Mirrors).To(HaveLen(1))
+		Expect(res.Mirrors[0].Host).To(Equal("mirror-a.example.com"))
+
+		_, res = get("/api/v1/mirrors?country=us&available=true", nil)
+
+		Expect(res.Mirrors).To(HaveLen(1))
+		Expect(res.Mirrors[0].Host).To(Equal("mirror-c.example.com"))
+
+		w, _ := get("/api/v1/mirrors?available=maybe", nil)
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("Should not send unchanged responses again", func() {
+		w, _ := get("/api/v1/mirrors", nil)
+
+		etag := w.Header().Get("ETag")
+
+		Expect(etag).ToNot(BeEmpty())
+
+		w, _ = get("/api/v1/mirrors", http.Header{"If-None-Match": {etag}})
+
+		Expect(w.Code).To(Equal(http.StatusNotModified))
+
+		// Every value of the response is covered by the ETag, including check results
+		r.servers[0].LastCheck = time.Now()
+
+		w, _ = get("/api/v1/mirrors", http.Header{"If-None-Match": {etag}})
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("ETag")).ToNot(Equal(etag))
+	})
+})
+
+var _ = Describe("Select API", func() {
+	var r *Redirector
+
+	BeforeEach(func() {
+		r = newGeoRedirector()
+		r.config.APIToken = "secret"
+	})
+
+	get := func(url string, token string) (*httptest.ResponseRecorder, SelectResponse) {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = berlinClient + ":1234"
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		r.selectHandler(w, req)
+
+		var res SelectResponse
+
+		if w.Code == http.StatusOK {
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+		}
+
+		return w, res
+	}
+
+	It("Should rank servers for the client", func() {
+		w, res := get("/api/v1/select?scheme=https&path=/dists/bookworm/InRelease", "")
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(res.IP).To(Equal(berlinClient))
+		Expect(res.Scheme).To(Equal("https"))
+		Expect(res.Servers).To(HaveLen(3))
+		Expect(res.Servers[0].Host).To(Equal("berlin.example.com"))
+		Expect(res.Servers[0].URL).To(Equal("https://berlin.example.com/apt/dists/bookworm/InRelease"))
+		Expect(res.Servers[1].Host).To(Equal("munich.example.com"))
+		Expect(res.Servers[2].Host).To(Equal("paris.example.com"))
+	})
+
+	It("Should cap the number of servers", func() {
+		_, res := get("/api/v1/select?n=1", "")
+
+		Expect(res.Servers).To(HaveLen(1))
+
+		_, res = get("/api/v1/select?n=100", "")
+
+		Expect(res.Servers).To(HaveLen(3))
+
+		_, res = get("/api/v1/select?n=0", "")
+
+		Expect(res.Servers).To(HaveLen(3))
+	})
+
+	It("Should only honour the ip override for trusted callers", func() {
+		w, _ := get("/api/v1/select?ip="+parisClient, "")
+
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+		w, _ = get("/api/v1/select?ip="+parisClient, "wrong")
+
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+		w, res := get("/api/v1/select?ip="+parisClient, "secret")
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(res.IP).To(Equal(parisClient))
+		Expect(res.Servers[0].Host).To(Equal("paris.example.com"))
+	})
+
+	It("Should reject invalid input", func() {
+		for _, url := range []string{
+			"/api/v1/select?scheme=foo",
+			"/api/v1/select?ipv6=maybe",
+		} {
+			w, _ := get(url, "")
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest), url)
+		}
+
+		w, _ := get("/api/v1/select?ip=invalid", "secret")
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+})
+
+var _ = Describe("Speed test API", func() {
+	It("Should be disabled without a test object", func() {
+		r := &Redirector{config: &Config{}}
+
+		w := httptest.NewRecorder()
+		r.speedTestHandler(w, httptest.NewRequest("GET", "/api/v1/speedtest", nil))
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+	})
+
+	Context("Manifest", func() {
+		var r *Redirector
+
+		BeforeEach(func() {
+			r = newGeoRedirector()
+			r.config.SpeedTestPath = "/speedtest/10MB.bin"
+			r.config.SpeedTestSize = "10MB"
+			r.servers = append(r.servers, &Server{Host: "cdn.example.com", Available: true, Protocols: []string{"https"}, Global: true, Distance: 1000, Weight: 10})
+		})
+
+		get := func(url string) SpeedTestResponse {
+			req := httptest.NewRequest("GET", url, nil)
+			req.RemoteAddr = berlinClient + ":1234"
+
+			w := httptest.NewRecorder()
+			r.speedTestHandler(w, req)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var res SpeedTestResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+
+			return res
+		}
+
+		It("Should list the test object on the top mirrors", func() {
+			res := get("/api/v1/speedtest?scheme=https&n=2")
+
+			Expect(res.IP).To(Equal(berlinClient))
+			Expect(res.Path).To(Equal("/speedtest/10MB.bin"))
+			Expect(res.Size).To(BeNumerically(">", 0))
+			Expect(res.Feedback).To(Equal("http://example.com/feedback"))
+			Expect(res.Mirrors).To(HaveLen(2))
+			Expect(res.Mirrors[0].URL).To(Equal("https://berlin.example.com/apt/speedtest/10MB.bin"))
+			Expect(res.Mirrors[1].URL).To(Equal("https://munich.example.com/apt/speedtest/10MB.bin"))
+		})
+
+		It("Should rank mirrors like Closest, without global backends", func() {
+			res := get("/api/v1/speedtest?scheme=https")
+
+			closest, _, err := r.servers.Closest(r, "https", net.ParseIP(berlinClient), false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(res.Mirrors[0].Host).To(Equal(closest.Host))
+			Expect(lo.Map(res.Mirrors, func(m SpeedTestMirror, _ int) string { return m.Host })).To(Equal([]string{
+				"berlin.example.com",
+				"munich.example.com",
+				"paris.example.com",
+			}))
+		})
+	})
+})
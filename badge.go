@@ -0,0 +1,250 @@
+package redirector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrUnknownMetric is returned when a badge is requested for an unknown metric.
+var ErrUnknownMetric = errors.New("unknown badge metric")
+
+// Badge colors, matching shields.io.
+const (
+	badgeBrightGreen = "#4c1"
+	badgeGreen       = "#97ca00"
+	badgeYellow      = "#dfb317"
+	badgeOrange      = "#fe7d37"
+	badgeRed         = "#e05d44"
+	badgeGrey        = "#9f9f9f"
+	badgeLabel       = "#555"
+)
+
+// Badge is a shields-style badge with a label and a colored message.
+type Badge struct {
+	Label   string
+	Message string
+	Color   string
+}
+
+// serverBadge builds the badge of a server metric: status, uptime (over the last days), latency or sync.
+// A nil server gets an unknown status badge.
+func serverBadge(server *Server, metric string, days int, now time.Time) (Badge, error) {
+	if server == nil {
+		return Badge{Label: "mirror", Message: "unknown", Color: badgeGrey}, nil
+	}
+
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	switch metric {
+	case "", "status":
+		if server.Available {
+			return Badge{Label: "mirror", Message: "online", Color: badgeBrightGreen}, nil
+		}
+
+		return Badge{Label: "mirror", Message: "offline", Color: badgeRed}, nil
+	case "uptime":
+		badge := Badge{Label: "uptime " + strconv.Itoa(days) + "d", Message: "n/a", Color: badgeGrey}
+
+		ratio, ok := server.uptime.ratio(now, days)
+
+		if !ok {
+			return badge, nil
+		}
+
+		badge.Message = strconv.FormatFloat(ratio*100, 'f', 1, 64) + "%"
+
+		switch {
+		case ratio >= 0.99:
+			badge.Color = badgeBrightGreen
+		case ratio >= 0.95:
+			badge.Color = badgeGreen
+		case ratio >= 0.9:
+			badge.Color = badgeYellow
+		default:
+			badge.Color = badgeRed
+		}
+
+		return badge, nil
+	case "latency":
+		badge := Badge{Label: "latency", Message: "n/a", Color: badgeGrey}
+
+		if server.Latency <= 0 {
+			return badge, nil
+		}
+
+		badge.Message = strconv.FormatInt(server.Latency.Milliseconds(), 10) + " ms"
+
+		switch {
+		case server.Latency < 200*time.Millisecond:
+			badge.Color = badgeBrightGreen
+		case server.Latency < 500*time.Millisecond:
+			badge.Color = badgeYellow
+		default:
+			badge.Color = badgeOrange
+		}
+
+		return badge, nil
+	case "sync":
+		badge := Badge{Label: "last sync", Message: "n/a", Color: badgeGrey}
+
+		if server.LastSync.IsZero() {
+			return badge, nil
+		}
+
+		age := now.Sub(server.LastSync)
+
+		badge.Message = formatAge(age) + " ago"
+
+		switch {
+		case age < 6*time.Hour:
+			badge.Color = badgeBrightGreen
+		case age < 24*time.Hour:
+			badge.Color = badgeYellow
+		default:
+			badge.Color = badgeRed
+		}
+
+		return badge, nil
+	}
+
+	return Badge{}, ErrUnknownMetric
+}
+
+// formatAge formats a duration in its largest unit, like 5m, 3h or 2d.
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return strconv.Itoa(int(max(d, 0)/time.Minute)) + "m"
+	case d < 24*time.Hour:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+
+	return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+}
+
+// textWidth estimates the width in pixels of text in 11px Verdana.
+func textWidth(s string) int {
+	var width float64
+
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("ijlI.,:;|!' ", r):
+			width += 3.5
+		case strings.ContainsRune("mwMW%@", r):
+			width += 10.5
+		case r >= 'A' && r <= 'Z':
+			width += 7.5
+		default:
+			width += 6.8
+		}
+	}
+
+	return int(width + 0.5)
+}
+
+// Render renders the badge as SVG, in the flat (default), flat-square or plastic style.
+func (b Badge) Render(style string) []byte {
+	labelWidth := textWidth(b.Label) + 10
+	messageWidth := textWidth(b.Message) + 10
+	width := labelWidth + messageWidth
+
+	label := html.EscapeString(b.Label)
+	message := html.EscapeString(b.Message)
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, message)
+	fmt.Fprintf(&sb, `<title>%s: %s</title>`, label, message)
+
+	radius := 3
+	shadow := true
+
+	switch style {
+	case "flat-square":
+		radius = 0
+		shadow = false
+	case "plastic":
+		radius = 4
+		sb.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#fff" stop-opacity=".7"/><stop offset=".1" stop-color="#aaa" stop-opacity=".1"/><stop offset=".9" stop-opacity=".3"/><stop offset="1" stop-opacity=".5"/></linearGradient>`)
+	default:
+		sb.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	}
+
+	fmt.Fprintf(&sb, `<clipPath id="r"><rect width="%d" height="20" rx="%d" fill="#fff"/></clipPath>`, width, radius)
+	fmt.Fprintf(&sb, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/>`, labelWidth, badgeLabel, labelWidth, messageWidth, b.Color)
+
+	if shadow {
+		fmt.Fprintf(&sb, `<rect width="%d" height="20" fill="url(#s)"/>`, width)
+	}
+
+	sb.WriteString(`</g><g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+
+	for _, text := range []struct {
+		x     int
+		value string
+	}{
+		{labelWidth / 2, label},
+		{labelWidth + messageWidth/2, message},
+	} {
+		if shadow {
+			fmt.Fprintf(&sb, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text>`, text.x, text.value)
+		}
+
+		fmt.Fprintf(&sb, `<text x="%d" y="14">%s</text>`, text.x, text.value)
+	}
+
+	sb.WriteString(`</g></svg>`)
+
+	return []byte(sb.String())
+}
+
+// mirrorStatusHandler is a fancy svg-returning handler.
+// it is used to display mirror statuses on a config repo of sorts
+// Query parameters:
+//   - metric: status (default), uptime, latency or sync
+//   - days: the uptime period in days, up to 30 (default 30)
+//   - style: flat (default), flat-square or plastic
+//   - label: a custom label
+func (r *Redirector) mirrorStatusHandler(w http.ResponseWriter, req *http.Request) {
+	serverHost := strings.Replace(chi.URLParam(req, "server"), "_", ".", -1)
+
+	query := req.URL.Query()
+
+	badge, err := serverBadge(r.hostMap[serverHost], query.Get("metric"), queryInt(req, "days", uptimeDays, uptimeDays), time.Now())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if label := query.Get("label"); label != "" {
+		badge.Label = label
+	}
+
+	svg := badge.Render(query.Get("style"))
+
+	sum := sha256.Sum256(svg)
+	etag := "\"" + hex.EncodeToString(sum[:8]) + "\""
+
+	w.Header().Set("Content-Type", "image/svg+xml;charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=120")
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(svg)))
+	w.Write(svg)
+}
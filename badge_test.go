@@ -0,0 +1,84 @@
+package redirector
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Badges", func() {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	It("Should show the status of a server", func() {
+		badge, err := serverBadge(&Server{Available: true}, "", uptimeDays, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge).To(Equal(Badge{Label: "mirror", Message: "online", Color: badgeBrightGreen}))
+
+		badge, err = serverBadge(nil, "uptime", uptimeDays, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge.Message).To(Equal("unknown"))
+	})
+
+	It("Should show the uptime over the requested days", func() {
+		server := &Server{}
+
+		// 10 days ago, the server was down
+		server.uptime.record(now.AddDate(0, 0, -10), false)
+
+		for i := 0; i < 3; i++ {
+			server.uptime.record(now.Add(-time.Duration(i)*time.Hour), true)
+		}
+
+		badge, err := serverBadge(server, "uptime", 7, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge.Label).To(Equal("uptime 7d"))
+		Expect(badge.Message).To(Equal("100.0%"))
+
+		badge, err = serverBadge(server, "uptime", 30, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge.Message).To(Equal("75.0%"))
+		Expect(badge.Color).To(Equal(badgeRed))
+	})
+
+	It("Should show latency and sync age", func() {
+		server := &Server{Latency: 150 * time.Millisecond, LastSync: now.Add(-3 * time.Hour)}
+
+		badge, err := serverBadge(server, "latency", uptimeDays, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge.Message).To(Equal("150 ms"))
+
+		badge, err = serverBadge(server, "sync", uptimeDays, now)
+
+		Expect(err).To(BeNil())
+		Expect(badge.Message).To(Equal("3h ago"))
+		Expect(badge.Color).To(Equal(badgeBrightGreen))
+
+		_, err = serverBadge(server, "bogus", uptimeDays, now)
+
+		Expect(err).To(Equal(ErrUnknownMetric))
+	})
+
+	It("Should render escaped svg in different styles", func() {
+		badge := Badge{Label: "a<b", Message: "online", Color: badgeGreen}
+
+		Expect(string(badge.Render(""))).To(ContainSubstring(`rx="3"`))
+		Expect(string(badge.Render(""))).To(ContainSubstring("a&lt;b"))
+		Expect(string(badge.Render("flat-square"))).To(ContainSubstring(`rx="0"`))
+		Expect(string(badge.Render("flat-square"))).ToNot(ContainSubstring("linearGradient"))
+	})
+
+	It("Should match etags", func() {
+		req := httptest.NewRequest("GET", "/mirrors/mirror.svg", nil)
+		req.Header.Set("If-None-Match", `"abc", W/"def"`)
+
+		Expect(etagMatches(req, `"def"`)).To(BeTrue())
+		Expect(etagMatches(req, `"xyz"`)).To(BeFalse())
+	})
+})
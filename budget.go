@@ -0,0 +1,88 @@
+package redirector
+
+import (
+	"math"
+	"time"
+)
+
+// budgetSoftLimit is the fraction of a monthly budget after which a server's weight is reduced.
+// Once the budget is fully used, the server is no longer chosen until the next month.
+const budgetSoftLimit = 0.8
+
+// usagePeriodFormat is the layout used to identify the current budget period (a calendar month, UTC).
+const usagePeriodFormat = "2006-01"
+
+// rollUsage resets the monthly usage when a new month has started.
+// The caller must hold the write lock.
+func (s *Server) rollUsage(now time.Time) {
+	period := now.UTC().Format(usagePeriodFormat)
+
+	if s.usagePeriod != period {
+		s.usagePeriod = period
+		s.MonthlyUsage = 0
+	}
+}
+
+// addUsage accounts the estimated bytes of a redirect against the server.
+func (s *Server) addUsage(bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+
+	if s.BytesServed != nil {
+		s.BytesServed.Add(float64(bytes))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollUsage(time.Now())
+	s.MonthlyUsage += bytes
+}
+
+// budgetUsed returns the used fraction of the monthly budget, or 0 if the server has no budget.
+// The budget is set once when the server is added, so servers without one don't take the lock.
+func (s *Server) budgetUsed() float64 {
+	if s.MonthlyBudget <= 0 {
+		return 0
+	}
+
+	period := time.Now().UTC().Format(usagePeriodFormat)
+
+	s.mu.RLock()
+
+	if s.usagePeriod == period {
+		defer s.mu.RUnlock()
+
+		return float64(s.MonthlyUsage) / float64(s.MonthlyBudget)
+	}
+
+	s.mu.RUnlock()
+
+	// A new month started, reset the usage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollUsage(time.Now())
+
+	return float64(s.MonthlyUsage) / float64(s.MonthlyBudget)
+}
+
+// overBudget returns true if the server has used up its monthly budget.
+func (s *Server) overBudget() bool {
+	return s.budgetUsed() >= 1
+}
+
+// effectiveWeight is the server weight, linearly reduced once the server nears its monthly budget.
+// It never drops below 1, as exhausted servers are filtered out instead.
+func (s *Server) effectiveWeight() int {
+	used := s.budgetUsed()
+
+	if used <= budgetSoftLimit {
+		return s.Weight
+	}
+
+	remaining := (1 - used) / (1 - budgetSoftLimit)
+
+	return int(math.Max(1, math.Round(float64(s.Weight)*remaining)))
+}
@@ -0,0 +1,60 @@
+package redirector
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monthly budgets", func() {
+	var server *Server
+
+	BeforeEach(func() {
+		server = &Server{
+			Host:          "mirror.example.com",
+			Weight:        10,
+			MonthlyBudget: 1000,
+		}
+	})
+
+	It("Should keep the full weight below the soft limit", func() {
+		server.addUsage(500)
+
+		Expect(server.effectiveWeight()).To(Equal(10))
+		Expect(server.overBudget()).To(BeFalse())
+	})
+
+	It("Should reduce the weight when nearing the budget", func() {
+		server.addUsage(900)
+
+		Expect(server.effectiveWeight()).To(Equal(5))
+		Expect(server.overBudget()).To(BeFalse())
+	})
+
+	It("Should exhaust the server at the budget", func() {
+		server.addUsage(1000)
+
+		Expect(server.effectiveWeight()).To(Equal(1))
+		Expect(server.overBudget()).To(BeTrue())
+	})
+
+	It("Should reset the usage when a new month starts", func() {
+		server.addUsage(1000)
+		now := time.Now().UTC()
+		lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+
+		server.usagePeriod = lastMonth.Format(usagePeriodFormat)
+
+		Expect(server.overBudget()).To(BeFalse())
+		Expect(server.MonthlyUsage).To(BeZero())
+	})
+
+	It("Should ignore usage for servers without a budget", func() {
+		server.MonthlyBudget = 0
+		server.addUsage(1 << 40)
+
+		Expect(server.effectiveWeight()).To(Equal(10))
+		Expect(server.overBudget()).To(BeFalse())
+	})
+})
@@ -57,12 +57,18 @@ func (h *HTTPCheck) checkHTTPScheme(server *Server, scheme string, logFields log
 
 	req.Header.Set("User-Agent", "ArmbianRouter/1.0 (Go "+runtime.Version()+")")
 
+	start := time.Now()
+
 	res, err := h.config.checkClient.Do(req)
 	if err != nil {
 		return false, err
 	}
 	defer res.Body.Close()
 
+	server.mu.Lock()
+	server.Latency = time.Since(start)
+	server.mu.Unlock()
+
 	logFields["responseCode"] = res.StatusCode
 
 	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusMovedPermanently || res.StatusCode == http.StatusPermanentRedirect || res.StatusCode == http.StatusFound || res.StatusCode == http.StatusNotFound {
@@ -238,7 +244,12 @@ type IPv6Check struct {
 }
 
 // Check verifies IPv6 support for the server by checking for AAAA records
+// Servers with an IPv6 specific host get their IPv6 support from checking that host instead.
 func (i *IPv6Check) Check(server *Server, logFields log.Fields) (bool, error) {
+	if server.IPv6Host != "" {
+		return true, nil
+	}
+
 	// Extract host from server (handle host:port format)
 	host := server.Host
 	if strings.Contains(host, ":") {
@@ -357,6 +368,13 @@ func (v *VersionCheck) Check(server *Server, logFields log.Fields) (bool, error)
 		return false, nil
 	}
 
+	// The modification time of the control file tells when the mirror last synced
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		server.mu.Lock()
+		server.LastSync = modified
+		server.mu.Unlock()
+	}
+
 	b, err := io.ReadAll(io.LimitReader(res.Body, 128))
 
 	if err != nil {
@@ -0,0 +1,229 @@
+package redirector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checksumFetchers is the number of concurrent checksum downloads in the background.
+const checksumFetchers = 8
+
+// checksumRetryDelay is how long a failed checksum download is remembered before it is retried.
+const checksumRetryDelay = 5 * time.Minute
+
+// ErrInvalidChecksum is returned when a .sha companion does not hold a SHA-256 checksum.
+var ErrInvalidChecksum = errors.New("invalid sha256 checksum file")
+
+// checksumFailure is a failed checksum download, remembered until checksumRetryDelay passed.
+type checksumFailure struct {
+	err error
+	at  time.Time
+}
+
+// checksumCall is an in-flight checksum download, shared by all concurrent callers of the same url.
+type checksumCall struct {
+	done chan struct{}
+	sum  string
+	err  error
+}
+
+// checksumStore caches the SHA-256 checksums of mapped files, read from their .sha companions.
+// It is reset on every map reload.
+type checksumStore struct {
+	config     *Config
+	mu         sync.Mutex
+	sums       map[string]string
+	failures   map[string]checksumFailure
+	calls      map[string]*checksumCall
+	fetchers   chan struct{}
+	generation int
+}
+
+func newChecksumStore(config *Config) *checksumStore {
+	return &checksumStore{
+		config:   config,
+		sums:     make(map[string]string),
+		failures: make(map[string]checksumFailure),
+		calls:    make(map[string]*checksumCall),
+		fetchers: make(chan struct{}, checksumFetchers),
+	}
+}
+
+// reset drops all cached checksums and failures.
+func (c *checksumStore) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sums = make(map[string]string)
+	c.failures = make(map[string]checksumFailure)
+	c.calls = make(map[string]*checksumCall)
+	c.generation++
+}
+
+// peek returns a cached checksum without fetching it.
+func (c *checksumStore) peek(shaURL string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sum, ok := c.sums[shaURL]
+
+	return sum, ok
+}
+
+// load fetches a checksum in the background, if it isn't cached or already being fetched.
+// At most checksumFetchers downloads run at once; other urls are skipped, and loaded by a later call.
+func (c *checksumStore) load(shaURL string) {
+	select {
+	case c.fetchers <- struct{}{}:
+	default:
+		return
+	}
+
+	go func() {
+		defer func() { <-c.fetchers }()
+
+		if _, err := c.get(shaURL); err != nil {
+			log.WithError(err).WithField("url", shaURL).Debug("Unable to load checksum")
+		}
+	}()
+}
+
+// get returns the hex encoded checksum from a .sha companion url, fetching it if it isn't cached.
+// Concurrent calls for the same url share a single download, and failures are cached for checksumRetryDelay.
+func (c *checksumStore) get(shaURL string) (string, error) {
+	c.mu.Lock()
+
+	if sum, ok := c.sums[shaURL]; ok {
+		c.mu.Unlock()
+		return sum, nil
+	}
+
+	if failure, ok := c.failures[shaURL]; ok && time.Since(failure.at) < checksumRetryDelay {
+		c.mu.Unlock()
+		return "", failure.err
+	}
+
+	if call, ok := c.calls[shaURL]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.sum, call.err
+	}
+
+	call := &checksumCall{done: make(chan struct{})}
+	c.calls[shaURL] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	call.sum, call.err = c.fetch(shaURL)
+	close(call.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Results of downloads started before a reset belong to the previous map
+	if c.generation != generation {
+		return call.sum, call.err
+	}
+
+	delete(c.calls, shaURL)
+
+	if call.err != nil {
+		c.failures[shaURL] = checksumFailure{err: call.err, at: time.Now()}
+	} else {
+		c.sums[shaURL] = call.sum
+		delete(c.failures, shaURL)
+	}
+
+	return call.sum, call.err
+}
+
+// fetch downloads a .sha companion, which is in the sha256sum format ("HASH  FILENAME").
+func (c *checksumStore) fetch(shaURL string) (string, error) {
+	b, err := fetchCompanion(c.config, shaURL, 4096)
+
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksum(bytes.NewReader(b))
+}
+
+// fetchCompanion downloads a companion file of a mapped image, like its .sha or .torrent, up to limit bytes.
+func fetchCompanion(config *Config, companionURL string, limit int64) ([]byte, error) {
+	if !strings.HasPrefix(companionURL, "http://") && !strings.HasPrefix(companionURL, "https://") {
+		return nil, fmt.Errorf("unsupported companion url %q", companionURL)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, companionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "ArmbianRouter/1.0 (Go "+runtime.Version()+")")
+
+	res, err := fetchClient(config).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %d", res.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, limit))
+}
+
+// fetchClient returns a client which shares the transport of the check client, if it is set up,
+// but follows redirects, as companions and maps are usually served through a redirector or CDN.
+func fetchClient(config *Config) *http.Client {
+	transport := http.DefaultTransport
+
+	if config.checkClient != nil && config.checkClient.Transport != nil {
+		transport = config.checkClient.Transport
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   20 * time.Second,
+	}
+}
+
+// parseChecksum reads the first SHA-256 checksum of a sha256sum formatted file.
+func parseChecksum(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		sum := strings.ToLower(fields[0])
+
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+			return "", ErrInvalidChecksum
+		}
+
+		return sum, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", ErrInvalidChecksum
+}
@@ -28,6 +28,8 @@ func main() {
 	viper.SetDefault("cacheSize", 1024)
 	viper.SetDefault("topChoices", 3)
 	viper.SetDefault("reloadKey", util.RandomSequence(32))
+	viper.SetDefault("mapAliases.latest", "latest")
+	viper.SetDefault("mapAliases.promoted", "promoted")
 
 	viper.SetConfigName("dlrouter")        // name of config file (without extension)
 	viper.SetConfigType("yaml")            // REQUIRED if the config file does not have the extension in the name
@@ -91,7 +93,7 @@ func main() {
 
 	log.Info("Ready")
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 
 	signal.Notify(c, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
 
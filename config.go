@@ -11,11 +11,10 @@ import (
 	"time"
 
 	"github.com/armbian/redirector/db"
+	"github.com/armbian/redirector/util"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/oschwald/maxminddb-golang"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,8 +35,16 @@ type Config struct {
 	ASNDBPath string `mapstructure:"asndb"`
 
 	// MapFile is a file used to map download urls via redirect.
+	// It can also be an http(s) url, which is polled every MapPollInterval.
 	MapFile string `mapstructure:"dl_map"`
 
+	// MapPollInterval is the interval at which a remote download map is polled for changes.
+	MapPollInterval time.Duration `mapstructure:"mapPollInterval"`
+
+	// MapCacheFile is an optional file keeping the last valid remote download map,
+	// which is loaded on start if the remote map can't be fetched.
+	MapCacheFile string `mapstructure:"mapCacheFile"`
+
 	// CacheSize is the number of items to keep in the LRU cache.
 	CacheSize int `mapstructure:"cacheSize"`
 
@@ -48,18 +55,69 @@ type Config struct {
 	// ReloadToken is a secret token used for web-based reload.
 	ReloadToken string `mapstructure:"reloadToken"`
 
+	// APIToken is a secret token for trusted API callers, like the ip override of /api/v1/select.
+	APIToken string `mapstructure:"apiToken"`
+
 	// CheckURL is the url used to verify mirror versions
 	CheckURL string `mapstructure:"checkUrl"`
 
 	// SameCityThreshold is the parameter used to specify a threshold between mirrors and the client
 	SameCityThreshold float64 `mapstructure:"sameCityThreshold"`
 
+	// FeedbackSecret is an optional secret used to verify signed download feedback.
+	// If set, reports must carry an HMAC-SHA256 signature of the body in X-Signature.
+	FeedbackSecret string `mapstructure:"feedbackSecret"`
+
+	// FeedbackRateLimit is the number of feedback reports accepted per client per minute.
+	FeedbackRateLimit int `mapstructure:"feedbackRateLimit"`
+
+	// FeedbackSlowThroughput is the throughput (in bytes per second) under which
+	// a successful download is considered a poor result.
+	FeedbackSlowThroughput float64 `mapstructure:"feedbackSlowThroughput"`
+
+	// GlobalDistance is the default effective distance (in meters) of global servers to every client.
+	GlobalDistance float64 `mapstructure:"globalDistance"`
+
+	// MirrorlistFallback is an optional url appended with the lowest priority to apt mirrorlists,
+	// like the redirector itself.
+	MirrorlistFallback string `mapstructure:"mirrorlistFallback"`
+
+	// LinkHeaders is the number of next-best mirrors to add as RFC 6249 Link headers to redirects.
+	// If 0, no Link headers are added.
+	LinkHeaders int `mapstructure:"linkHeaders"`
+
+	// DigestHeaders enables Digest and Content-Digest headers on redirects of mapped files.
+	// Checksums are loaded from the .sha companions once per map reload.
+	DigestHeaders bool `mapstructure:"digestHeaders"`
+
+	// DynamicTorrents serves the torrents of mapped images with the client's closest mirrors
+	// as web seeds, instead of redirecting to the static torrent files.
+	DynamicTorrents bool `mapstructure:"dynamicTorrents"`
+
+	// LandingPages serves browsers requesting mapped images an HTML page with the image details,
+	// verification files and alternative mirrors, which starts the download from the best mirror.
+	LandingPages bool `mapstructure:"landingPages"`
+
+	// SpeedTestPath is the path of a test object on every mirror, used by clients to measure throughput.
+	// The speed test api is disabled if it is empty.
+	SpeedTestPath string `mapstructure:"speedTestPath"`
+
+	// SpeedTestSize is the size of the test object, like "10MB".
+	SpeedTestSize string `mapstructure:"speedTestSize"`
+
 	// ServerList is a list of ServerConfig structs, which gets parsed into servers.
 	ServerList []ServerConfig `mapstructure:"servers"`
 
 	// Special extensions for the download map
 	SpecialExtensions map[string]string `mapstructure:"specialExtensions"`
 
+	// MapColumns maps the fields of CSV download maps to the names of their columns,
+	// like file_url: url. Fields without a mapping use their own name.
+	MapColumns map[string]string `mapstructure:"mapColumns"`
+
+	// MapAliases configures the alias keys generated for the download map.
+	MapAliases MapAliases `mapstructure:"mapAliases"`
+
 	// LogLevel is the log level to use for the application.
 	// It can be one of: "debug", "info", "warn", "error", "fatal", "panic".
 	// If not set, it defaults to "warn".
@@ -138,16 +196,22 @@ func (r *Redirector) ReloadConfig() error {
 	log.SetLevel(level)
 
 	// db can be hot-reloaded if the file changed
-	r.db, err = maxminddb.Open(r.config.GeoDBPath)
+	geoDB, err := maxminddb.Open(r.config.GeoDBPath)
 	if err != nil {
+		r.db = nil
 		return errors.Wrap(err, "Unable to open database")
 	}
 
+	r.db = geoDB
+
 	if r.config.ASNDBPath != "" {
-		r.asnDB, err = maxminddb.Open(r.config.ASNDBPath)
+		asnDB, err := maxminddb.Open(r.config.ASNDBPath)
 		if err != nil {
+			r.asnDB = nil
 			return errors.Wrap(err, "Unable to open asn database")
 		}
+
+		r.asnDB = asnDB
 	}
 
 	// Refresh server cache if size changed
@@ -161,7 +225,7 @@ func (r *Redirector) ReloadConfig() error {
 	r.serverCache.Purge()
 
 	// Reload map file
-	if err := r.reloadMap(); err != nil {
+	if err := r.reloadConfiguredMap(); err != nil {
 		return errors.Wrap(err, "Unable to load map file")
 	}
 
@@ -181,6 +245,12 @@ func (r *Redirector) ReloadConfig() error {
 	hosts := make(map[string]*Server)
 	for _, server := range r.servers {
 		hosts[server.Host] = server
+
+		for _, host := range []string{server.IPv4Host, server.IPv6Host} {
+			if host != "" {
+				hosts[host] = server
+			}
+		}
 	}
 	r.hostMap = hosts
 
@@ -196,6 +266,20 @@ func (r *Redirector) ReloadConfig() error {
 		r.config.SameCityThreshold = 200000.0
 	}
 
+	if r.config.GlobalDistance == 0 {
+		r.config.GlobalDistance = 1000000.0
+	}
+
+	if r.config.FeedbackRateLimit == 0 {
+		r.config.FeedbackRateLimit = 10
+	}
+
+	if r.config.FeedbackSlowThroughput == 0 {
+		r.config.FeedbackSlowThroughput = 512 * 1024
+	}
+
+	r.events.publish(EventConfigReload, struct{}{})
+
 	// Force check
 	go r.servers.Check(r, r.checks)
 
@@ -268,15 +352,13 @@ func (r *Redirector) reloadServers() error {
 	for _, update := range updates {
 		if update.index >= 0 && update.index < len(r.servers) {
 			// Update existing server
-			update.server.Redirects = r.servers[update.index].Redirects
+			update.server.inherit(r.servers[update.index])
 			r.servers[update.index] = update.server
 		} else if update.index == -1 {
 			// Add new server
-			update.server.Redirects = promauto.NewCounter(prometheus.CounterOpts{
-				Name: "armbian_router_redirects_" + metricReplacer.Replace(update.server.Host),
-				Help: "The number of redirects for server " + update.server.Host,
-			})
+			update.server.registerMetrics()
 			r.servers = append(r.servers, update.server)
+			r.events.publish(EventServerAdded, ServerEvent{Host: update.server.Host})
 			log.WithFields(log.Fields{
 				"server":    update.server.Host,
 				"path":      update.server.Path,
@@ -295,6 +377,7 @@ func (r *Redirector) reloadServers() error {
 		log.WithFields(log.Fields{
 			"server": r.servers[i].Host,
 		}).Info("Removed server")
+		r.events.publish(EventServerRemoved, ServerEvent{Host: r.servers[i].Host})
 		r.servers = append(r.servers[:i], r.servers[i+1:]...)
 	}
 	serversLock.Unlock()
@@ -317,6 +400,10 @@ func (r *Redirector) addServer(server ServerConfig, u *url.URL) (*Server, error)
 		Weight:    server.Weight,
 		Protocols: []string{"http", "https"},
 		Rules:     server.Rules,
+		IPv4Host:  server.IPv4Host,
+		IPv6Host:  server.IPv6Host,
+		Global:    server.Global,
+		Distance:  server.Distance,
 	}
 	if len(server.Protocols) > 0 {
 		for _, proto := range server.Protocols {
@@ -325,10 +412,41 @@ func (r *Redirector) addServer(server ServerConfig, u *url.URL) (*Server, error)
 			}
 		}
 	}
+	if server.RsyncModule != "" && !lo.Contains(s.Protocols, rsyncProtocol) {
+		s.Protocols = append(s.Protocols, rsyncProtocol)
+	}
+	if lo.Contains(s.Protocols, rsyncProtocol) {
+		s.RsyncModule = strings.Trim(server.RsyncModule, "/")
+
+		// Mirrors usually name their module like the first part of their path
+		if s.RsyncModule == "" {
+			s.RsyncModule, _, _ = strings.Cut(strings.Trim(u.Path, "/"), "/")
+		}
+	}
 	// Defaults to 10 to allow servers to be set lower for lower priority
 	if s.Weight == 0 {
 		s.Weight = 10
 	}
+	rewrites, err := compileRewrites(server.Rewrites)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"server": s.Host,
+		}).Warning("Invalid rewrite")
+		return nil, err
+	}
+	s.Rewrites = rewrites
+	if server.MonthlyBudget != "" {
+		budget, err := util.ParseSize(server.MonthlyBudget)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"server": s.Host,
+			}).Warning("Invalid monthly budget")
+			return nil, err
+		}
+		s.MonthlyBudget = budget
+	}
 	ips, err := net.LookupIP(u.Host)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -346,7 +464,13 @@ func (r *Redirector) addServer(server ServerConfig, u *url.URL) (*Server, error)
 			break
 		}
 	}
-	s.IPv6 = hasIPv6
+	// Servers with an IPv6 specific host are assumed to support it until checked
+	s.IPv6 = hasIPv6 || s.IPv6Host != ""
+
+	// Global servers are anycast or CDN backends, so their first IP says nothing about their location
+	if s.Global {
+		return s, nil
+	}
 
 	var city db.City
 	err = r.db.Lookup(ips[0], &city)
@@ -369,16 +493,76 @@ func (r *Redirector) addServer(server ServerConfig, u *url.URL) (*Server, error)
 	return s, nil
 }
 
+// reloadConfiguredMap reloads the download map on config reloads, and follows its changes.
+// If the map can't be loaded, the previous map is kept; it is only an error if there is none.
+func (r *Redirector) reloadConfiguredMap() error {
+	if err := r.reloadMap(); err != nil {
+		if r.dlMap.Load() == nil {
+			return err
+		}
+
+		log.WithError(err).Warning("Unable to reload download map, keeping the previous one")
+	}
+
+	// Follow changes of the map, which may have moved to another file or url
+	if err := r.followMap(); err != nil {
+		log.WithError(err).Warning("Unable to watch download map")
+	}
+
+	return nil
+}
+
+// reloadMap loads the download map and swaps it in once it is valid.
+// On errors, the previous map is kept.
 func (r *Redirector) reloadMap() error {
 	mapFile := r.config.MapFile
 	if mapFile == "" {
 		return nil
 	}
-	log.WithField("file", mapFile).Info("Loading download map")
-	newMap, err := loadMapFile(mapFile, r.config.SpecialExtensions)
+
+	r.mapLock.Lock()
+	defer r.mapLock.Unlock()
+
+	var newMap *DownloadMap
+	var err error
+	refreshed := time.Now()
+
+	if isRemoteMap(mapFile) {
+		newMap, refreshed, err = r.fetchMap(mapFile)
+
+		if errors.Is(err, errMapNotModified) {
+			mapRefreshed.Store(refreshed.UnixNano())
+			return nil
+		}
+	} else {
+		log.WithField("file", mapFile).Info("Loading download map")
+		newMap, err = loadMapFile(mapFile, r.config)
+	}
+	if err == nil {
+		err = newMap.validate()
+	}
 	if err != nil {
+		mapReloadFailures.Inc()
 		return err
 	}
-	r.dlMap = newMap
+	r.dlMap.Store(newMap)
+
+	// Validators only apply to the map fetched with them, not to local or cached maps
+	if newMap != r.remoteMap.dm {
+		r.remoteMap = remoteMapState{}
+	}
+
+	mapReloads.Inc()
+	mapRefreshed.Store(refreshed.UnixNano())
+	mapEntries.Set(float64(len(newMap.Paths)))
+	mapImages.Set(float64(len(newMap.Images)))
+	r.checksums.reset()
+	r.torrents.reset()
+
+	r.events.publish(EventMapReload, MapEvent{
+		Entries: len(newMap.Paths),
+		Images:  len(newMap.Images),
+	})
+
 	return nil
 }
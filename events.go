@@ -0,0 +1,205 @@
+package redirector
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types sent on the event stream.
+const (
+	EventServerUp      = "server.up"
+	EventServerDown    = "server.down"
+	EventServerAdded   = "server.added"
+	EventServerRemoved = "server.removed"
+	EventConfigReload  = "config.reloaded"
+	EventMapReload     = "map.reloaded"
+)
+
+// eventHistorySize is the number of past events kept to resume streams with Last-Event-ID.
+const eventHistorySize = 256
+
+// eventBufferSize is the number of events buffered per subscriber.
+// Subscribers falling further behind are disconnected, and can resume with Last-Event-ID.
+const eventBufferSize = 64
+
+// eventKeepAlive is the interval of keep-alive comments on idle streams.
+const eventKeepAlive = 30 * time.Second
+
+// Event is a state change sent on the event stream.
+type Event struct {
+	ID   uint64
+	Type string
+	Data any
+}
+
+// ServerEvent is the data of server events.
+type ServerEvent struct {
+	Host   string `json:"host"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MapEvent is the data of map reload events.
+type MapEvent struct {
+	Entries int `json:"entries"`
+	Images  int `json:"images"`
+}
+
+// eventBroker fans out events to the stream subscribers, keeping a short history for resuming.
+type eventBroker struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+}
+
+// newEventBroker creates an event broker without subscribers.
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// publish sends an event to every subscriber. It is a no-op on a nil broker.
+func (b *eventBroker) publish(eventType string, data any) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+
+	event := Event{
+		ID:   b.lastID,
+		Type: eventType,
+		Data: data,
+	}
+
+	b.history = append(b.history, event)
+
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The subscriber is too slow, it can reconnect and resume
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a subscriber, returning the events after lastID that it missed.
+// If lastID is unknown, like after a restart, the whole history is returned.
+func (b *eventBroker) subscribe(lastID uint64) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[ch] = struct{}{}
+
+	if lastID == 0 {
+		return ch, nil
+	}
+
+	var missed []Event
+
+	if lastID > b.lastID {
+		missed = append(missed, b.history...)
+	} else {
+		for _, event := range b.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return ch, missed
+}
+
+// unsubscribe removes a subscriber, if it was not already disconnected.
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// writeEvent writes an event in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event.Data)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("id: " + strconv.FormatUint(event.ID, 10) + "\nevent: " + event.Type + "\ndata: " + string(data) + "\n\n"))
+
+	return err
+}
+
+// eventsHandler streams server state changes and reloads as Server-Sent Events.
+// Clients can resume a stream with the Last-Event-ID header.
+func (r *Redirector) eventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+
+	ch, missed := r.events.subscribe(lastID)
+	defer r.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			if err := writeEvent(w, event); err != nil {
+				log.WithError(err).Debug("Unable to write event")
+				return
+			}
+		case <-ticker.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,77 @@
+package redirector
+
+import (
+	"context"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Events", func() {
+	It("Should send events to subscribers", func() {
+		b := newEventBroker()
+
+		ch, missed := b.subscribe(0)
+
+		Expect(missed).To(BeEmpty())
+
+		b.publish(EventServerDown, ServerEvent{Host: "mirror.example.com", Reason: "timeout"})
+
+		Expect(<-ch).To(Equal(Event{ID: 1, Type: EventServerDown, Data: ServerEvent{Host: "mirror.example.com", Reason: "timeout"}}))
+
+		b.unsubscribe(ch)
+
+		Expect(ch).To(BeClosed())
+	})
+
+	It("Should return missed events after the last event id", func() {
+		b := newEventBroker()
+
+		for i := 0; i < 3; i++ {
+			b.publish(EventConfigReload, struct{}{})
+		}
+
+		_, missed := b.subscribe(1)
+
+		Expect(missed).To(HaveLen(2))
+		Expect(missed[0].ID).To(Equal(uint64(2)))
+
+		// Unknown ids, like from before a restart, get the whole history
+		_, missed = b.subscribe(100)
+
+		Expect(missed).To(HaveLen(3))
+	})
+
+	It("Should disconnect slow subscribers", func() {
+		b := newEventBroker()
+
+		ch, _ := b.subscribe(0)
+
+		for i := 0; i <= eventBufferSize; i++ {
+			b.publish(EventConfigReload, struct{}{})
+		}
+
+		Expect(ch).To(HaveLen(eventBufferSize))
+		Expect(b.subscribers).To(BeEmpty())
+	})
+
+	It("Should stream missed events", func() {
+		r := &Redirector{events: newEventBroker()}
+
+		r.events.publish(EventServerUp, ServerEvent{Host: "mirror.example.com"})
+		r.events.publish(EventMapReload, MapEvent{Entries: 10, Images: 2})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req := httptest.NewRequest("GET", "/events", nil).WithContext(ctx)
+		req.Header.Set("Last-Event-ID", "1")
+
+		w := httptest.NewRecorder()
+		r.eventsHandler(w, req)
+
+		Expect(w.Header().Get("Content-Type")).To(Equal("text/event-stream"))
+		Expect(w.Body.String()).To(Equal("id: 2\nevent: map.reloaded\ndata: {\"entries\":10,\"images\":2}\n\n"))
+	})
+})
@@ -0,0 +1,167 @@
+package redirector
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultFeedSize is the number of entries in the images feed.
+const defaultFeedSize = 50
+
+// maxFeedSize is the maximum number of entries in the images feed.
+const maxFeedSize = 500
+
+// AtomFeed is an Atom feed, as defined in RFC 4287.
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  AtomAuthor  `xml:"author"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+// AtomAuthor is the author of an Atom feed.
+type AtomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// AtomLink is a link of an Atom feed or entry.
+type AtomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Title  string `xml:"title,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+}
+
+// AtomEntry is an entry of an Atom feed.
+type AtomEntry struct {
+	ID       string         `xml:"id"`
+	Title    string         `xml:"title"`
+	Updated  string         `xml:"updated"`
+	Links    []AtomLink     `xml:"link"`
+	Category []AtomCategory `xml:"category"`
+	Summary  string         `xml:"summary"`
+}
+
+// AtomCategory is a category of an Atom entry.
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// imageTitle returns a human readable title of an image.
+func imageTitle(image *Image) string {
+	parts := []string{"Armbian"}
+
+	if image.Version != "" {
+		parts = append(parts, image.Version)
+	}
+
+	parts = append(parts, image.Board, distroCaser.String(image.Distro), image.Branch, image.Variant)
+
+	if image.Application != "" {
+		parts = append(parts, image.Application)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// imagesFeed builds an Atom feed of the newest n images matching the filter, with urls relative to base.
+func imagesFeed(dm *DownloadMap, base, self string, filter imageFilter, n int) AtomFeed {
+	var images []*Image
+
+	for _, image := range dm.Images {
+		if filter.match(image) {
+			images = append(images, image)
+		}
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Updated.After(images[j].Updated)
+	})
+
+	if len(images) > n {
+		images = images[:n]
+	}
+
+	feed := AtomFeed{
+		ID:      self,
+		Title:   "Armbian images",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  AtomAuthor{Name: "Armbian"},
+		Links: []AtomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+		},
+		Entries: make([]AtomEntry, len(images)),
+	}
+
+	if len(images) > 0 && !images[0].Updated.IsZero() {
+		feed.Updated = images[0].Updated.UTC().Format(time.RFC3339)
+	}
+
+	for i, image := range images {
+		entry := newImageEntry(image, base)
+
+		// Keys are reused by newer builds, the asset url is unique per build
+		atomEntry := AtomEntry{
+			ID:      image.File.FileURL,
+			Title:   imageTitle(image),
+			Updated: image.Updated.UTC().Format(time.RFC3339),
+			Links: []AtomLink{
+				{Rel: "alternate", Href: entry.URL},
+				{Rel: "enclosure", Length: image.Size, Href: entry.URL},
+			},
+			Category: []AtomCategory{{Term: image.Board}, {Term: image.Distro}},
+			Summary:  imageTitle(image) + " (" + image.Extension + ")",
+		}
+
+		for _, ext := range extensionFormats {
+			if link, ok := entry.Companions[strings.TrimPrefix(ext, ".")]; ok {
+				atomEntry.Links = append(atomEntry.Links, AtomLink{Rel: "related", Title: strings.TrimPrefix(ext, "."), Href: link})
+			}
+		}
+
+		feed.Entries[i] = atomEntry
+	}
+
+	return feed
+}
+
+// imagesFeedHandler returns an Atom feed of the newest images, filtered by board and distro.
+func (r *Redirector) imagesFeedHandler(w http.ResponseWriter, req *http.Request) {
+	dm := r.dlMap.Load()
+
+	if dm == nil {
+		http.Error(w, "No download map loaded", http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+
+	filter := imageFilter{
+		board:  query.Get("board"),
+		distro: query.Get("distro"),
+	}
+
+	base := requestScheme(req) + "://" + req.Host + "/"
+
+	feed := imagesFeed(dm, base, base+strings.TrimLeft(req.URL.RequestURI(), "/"), filter, queryInt(req, "n", defaultFeedSize, maxFeedSize))
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+
+	w.Write([]byte(xml.Header))
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(feed); err != nil {
+		log.WithError(err).Warning("Unable to encode feed")
+	}
+}
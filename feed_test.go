@@ -0,0 +1,71 @@
+package redirector
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Feed", func() {
+	data := `{
+	  "assets": [
+	    {
+	      "board_slug": "orangepi5",
+	      "armbian_version": "24.5.1",
+	      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+	      "file_url_sha": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz.sha",
+	      "file_updated": "2024-05-28T10:00:00Z",
+	      "file_size": "1000",
+	      "distro": "bookworm",
+	      "branch": "current",
+	      "variant": "minimal",
+	      "download_repository": "archive",
+	      "file_extension": "img.xz"
+	    },
+	    {
+	      "board_slug": "rock-5b",
+	      "armbian_version": "24.5.1",
+	      "file_url": "https://dl.armbian.com/rock-5b/archive/Armbian_24.5.1_Rock-5b_noble_vendor_6.1.43_minimal.img.xz",
+	      "file_updated": "2024-05-29T10:00:00Z",
+	      "file_size": "2000",
+	      "distro": "noble",
+	      "branch": "vendor",
+	      "variant": "minimal",
+	      "download_repository": "archive",
+	      "file_extension": "img.xz"
+	    }
+	  ]
+	}`
+
+	It("Should list the newest images first", func() {
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+
+		feed := imagesFeed(m, "https://dl.armbian.com/", "https://dl.armbian.com/feeds/images.atom", imageFilter{}, defaultFeedSize)
+
+		Expect(feed.Updated).To(Equal("2024-05-29T10:00:00Z"))
+		Expect(feed.Entries).To(HaveLen(2))
+		Expect(feed.Entries[0].Title).To(Equal("Armbian 24.5.1 rock-5b Noble vendor minimal"))
+		Expect(feed.Entries[1].ID).To(Equal("https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz"))
+		Expect(feed.Entries[1].Links).To(ContainElement(AtomLink{Rel: "alternate", Href: "https://dl.armbian.com/orangepi5/Bookworm_current_minimal"}))
+		Expect(feed.Entries[1].Links).To(ContainElement(AtomLink{Rel: "related", Title: "sha", Href: "https://dl.armbian.com/orangepi5/Bookworm_current_minimal.sha"}))
+	})
+
+	It("Should filter images by board and limit the entries", func() {
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+
+		feed := imagesFeed(m, "https://dl.armbian.com/", "https://dl.armbian.com/feeds/images.atom", imageFilter{board: "orangepi5"}, defaultFeedSize)
+
+		Expect(feed.Entries).To(HaveLen(1))
+		Expect(feed.Entries[0].Category).To(ContainElement(AtomCategory{Term: "orangepi5"}))
+
+		feed = imagesFeed(m, "https://dl.armbian.com/", "https://dl.armbian.com/feeds/images.atom", imageFilter{}, 1)
+
+		Expect(feed.Entries).To(HaveLen(1))
+		Expect(feed.Entries[0].Category).To(ContainElement(AtomCategory{Term: "rock-5b"}))
+	})
+})
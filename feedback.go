@@ -0,0 +1,336 @@
+package redirector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// feedbackAlpha is the smoothing factor of the moving average score.
+	feedbackAlpha = 0.2
+
+	// feedbackMinSamples is the number of reports needed before a score is used.
+	feedbackMinSamples = 5
+
+	// feedbackMinReporters is the number of distinct reporter networks needed before a score is used,
+	// so a single client can't demote a server for its whole ASN or country.
+	feedbackMinReporters = 3
+
+	// feedbackDemoteThreshold is the score under which a server is skipped for a network.
+	feedbackDemoteThreshold = 0.25
+
+	// feedbackTTL is how long a score is used after its last report.
+	feedbackTTL = 24 * time.Hour
+
+	// feedbackNetworks is the number of networks to keep scores for.
+	feedbackNetworks = 16384
+
+	// feedbackMaxBody is the maximum size of a feedback report.
+	feedbackMaxBody = 4096
+)
+
+var feedbackReceived = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "armbian_router_feedback",
+	Help: "The total number of accepted download feedback reports",
+})
+
+// Feedback is a download report sent by clients like armbian-config or the build framework.
+type Feedback struct {
+	// Host is the mirror the download was made from.
+	Host string `json:"host"`
+
+	// Throughput is the measured download speed in bytes per second.
+	Throughput float64 `json:"throughput,omitempty"`
+
+	// Failed is true if the download failed.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// feedbackScore is the aggregated feedback for a server from a single network.
+type feedbackScore struct {
+	Score      float64
+	Throughput float64
+	Samples    int
+	Updated    time.Time
+
+	// Reporters holds up to feedbackMinReporters distinct reporter networks.
+	Reporters map[string]struct{}
+}
+
+// usable returns true if the score is recent and backed by enough reports from distinct networks.
+func (s *feedbackScore) usable() bool {
+	return s.Samples >= feedbackMinSamples && len(s.Reporters) >= feedbackMinReporters && time.Since(s.Updated) <= feedbackTTL
+}
+
+// reporterNetwork returns the /24 (IPv4) or /48 (IPv6) network of a reporting client.
+func reporterNetwork(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// feedbackStore aggregates feedback per client network (ASN or country) and server.
+type feedbackStore struct {
+	mu       sync.Mutex
+	networks *lru.Cache
+	limiter  *lru.Cache
+}
+
+// rateWindow counts the reports of a single client in the current minute.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newFeedbackStore() *feedbackStore {
+	networks, _ := lru.New(feedbackNetworks)
+	limiter, _ := lru.New(feedbackNetworks)
+
+	return &feedbackStore{
+		networks: networks,
+		limiter:  limiter,
+	}
+}
+
+// feedbackKeys returns the network keys of a client, most specific first.
+func feedbackKeys(input RuleInput) []string {
+	var keys []string
+
+	if input.ASN.AutonomousSystemNumber != 0 {
+		keys = append(keys, "AS"+strconv.FormatUint(uint64(input.ASN.AutonomousSystemNumber), 10))
+	}
+
+	if input.Location.Country.IsoCode != "" {
+		keys = append(keys, input.Location.Country.IsoCode)
+	}
+
+	return keys
+}
+
+// allow applies the per client rate limit, returning false if the client sent too many reports.
+func (f *feedbackStore) allow(client string, limit int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	if v, ok := f.limiter.Get(client); ok {
+		window := v.(*rateWindow)
+
+		if now.Sub(window.start) < time.Minute {
+			window.count++
+			return window.count <= limit
+		}
+	}
+
+	f.limiter.Add(client, &rateWindow{start: now, count: 1})
+
+	return limit > 0
+}
+
+// record adds a report from the reporter network to the scores of every network the client belongs to.
+// It returns true if the server became demoted for one of the networks.
+func (f *feedbackStore) record(input RuleInput, reporter string, fb Feedback, slowThroughput float64) bool {
+	value := 1.0
+
+	if fb.Failed {
+		value = 0
+	} else if fb.Throughput > 0 && fb.Throughput < slowThroughput {
+		value = 0.5
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var demoted bool
+
+	for _, key := range feedbackKeys(input) {
+		var scores map[string]*feedbackScore
+
+		if v, ok := f.networks.Get(key); ok {
+			scores = v.(map[string]*feedbackScore)
+		} else {
+			scores = make(map[string]*feedbackScore)
+			f.networks.Add(key, scores)
+		}
+
+		score, ok := scores[fb.Host]
+
+		if !ok || time.Since(score.Updated) > feedbackTTL {
+			score = &feedbackScore{Score: 1, Reporters: make(map[string]struct{})}
+			scores[fb.Host] = score
+		}
+
+		wasDemoted := score.usable() && score.Score < feedbackDemoteThreshold
+
+		score.Score = feedbackAlpha*value + (1-feedbackAlpha)*score.Score
+		score.Samples++
+		score.Updated = time.Now()
+
+		if len(score.Reporters) < feedbackMinReporters {
+			score.Reporters[reporter] = struct{}{}
+		}
+
+		if fb.Throughput > 0 {
+			if score.Throughput == 0 {
+				score.Throughput = fb.Throughput
+			} else {
+				score.Throughput = feedbackAlpha*fb.Throughput + (1-feedbackAlpha)*score.Throughput
+			}
+		}
+
+		if !wasDemoted && score.usable() && score.Score < feedbackDemoteThreshold {
+			demoted = true
+		}
+	}
+
+	return demoted
+}
+
+// score returns the score of a server for the most specific network of the client with enough reports.
+func (f *feedbackStore) score(host string, input RuleInput) (float64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range feedbackKeys(input) {
+		v, ok := f.networks.Peek(key)
+
+		if !ok {
+			continue
+		}
+
+		score, ok := v.(map[string]*feedbackScore)[host]
+
+		if !ok || !score.usable() {
+			continue
+		}
+
+		return score.Score, true
+	}
+
+	return 1, false
+}
+
+// demoted returns true if a server performs too badly for the client's network to be chosen.
+func (f *feedbackStore) demoted(server *Server, input RuleInput) bool {
+	score, ok := f.score(server.Host, input)
+
+	return ok && score < feedbackDemoteThreshold
+}
+
+// weight returns the effective weight of a server, scaled by its score for the client's network.
+func (f *feedbackStore) weight(server *Server, input RuleInput) int {
+	weight := server.effectiveWeight()
+
+	score, ok := f.score(server.Host, input)
+
+	if !ok {
+		return weight
+	}
+
+	return int(math.Max(1, math.Round(float64(weight)*score)))
+}
+
+// validFeedbackSignature verifies the hex encoded HMAC-SHA256 signature of a report body.
+func validFeedbackSignature(secret string, body []byte, signature string) bool {
+	signature = strings.TrimPrefix(signature, "sha256=")
+
+	expected, err := hex.DecodeString(signature)
+
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// feedbackHandler accepts download reports from clients.
+// If feedbackSecret is set, reports must be signed with an X-Signature header.
+func (r *Redirector) feedbackHandler(w http.ResponseWriter, req *http.Request) {
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !r.feedback.allow(ip.String(), r.config.FeedbackRateLimit) {
+		http.Error(w, "Too many reports", http.StatusTooManyRequests)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, feedbackMaxBody))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.config.FeedbackSecret != "" && !validFeedbackSignature(r.config.FeedbackSecret, body, req.Header.Get("X-Signature")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var fb Feedback
+
+	if err := json.Unmarshal(body, &fb); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server, ok := r.hostMap[fb.Host]
+
+	if !ok {
+		http.Error(w, "Unknown host", http.StatusBadRequest)
+		return
+	}
+
+	// Reports for address family hosts count towards the server itself
+	fb.Host = server.Host
+
+	if fb.Throughput < 0 {
+		http.Error(w, "Invalid throughput", http.StatusBadRequest)
+		return
+	}
+
+	input, err := r.ruleInput(ip)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	feedbackReceived.Inc()
+
+	if r.feedback.record(input, reporterNetwork(ip), fb, r.config.FeedbackSlowThroughput) {
+		log.WithFields(log.Fields{
+			"host":    fb.Host,
+			"country": input.Location.Country.IsoCode,
+			"asn":     input.ASN.AutonomousSystemNumber,
+		}).Info("Server demoted by client feedback")
+
+		r.serverCache.Purge()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,113 @@
+package redirector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/armbian/redirector/db"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Feedback", func() {
+	var (
+		store  *feedbackStore
+		server *Server
+		input  RuleInput
+	)
+
+	reporters := []string{"192.0.2.0", "198.51.100.0", "203.0.113.0"}
+
+	BeforeEach(func() {
+		store = newFeedbackStore()
+		server = &Server{Host: "mirror.example.com", Weight: 10}
+		input = RuleInput{
+			ASN: db.ASN{AutonomousSystemNumber: 64512},
+			Location: db.City{
+				Country: db.Country{IsoCode: "DE"},
+			},
+		}
+	})
+
+	It("Should not use a score before enough reports", func() {
+		for i := 0; i < feedbackMinSamples-1; i++ {
+			store.record(input, reporters[i%len(reporters)], Feedback{Host: server.Host, Failed: true}, 0)
+		}
+
+		Expect(store.demoted(server, input)).To(BeFalse())
+		Expect(store.weight(server, input)).To(Equal(10))
+	})
+
+	It("Should demote a server after repeated failures", func() {
+		var demoted bool
+
+		for i := 0; i < 10; i++ {
+			demoted = store.record(input, reporters[i%len(reporters)], Feedback{Host: server.Host, Failed: true}, 0) || demoted
+		}
+
+		Expect(demoted).To(BeTrue())
+		Expect(store.demoted(server, input)).To(BeTrue())
+	})
+
+	It("Should not demote a server on reports from a single network", func() {
+		for i := 0; i < 10; i++ {
+			store.record(input, reporters[0], Feedback{Host: server.Host, Failed: true}, 0)
+		}
+
+		Expect(store.demoted(server, input)).To(BeFalse())
+		Expect(store.weight(server, input)).To(Equal(10))
+	})
+
+	It("Should group reporters by network", func() {
+		Expect(reporterNetwork(net.ParseIP("192.0.2.1"))).To(Equal(reporterNetwork(net.ParseIP("192.0.2.254"))))
+		Expect(reporterNetwork(net.ParseIP("192.0.2.1"))).ToNot(Equal(reporterNetwork(net.ParseIP("192.0.3.1"))))
+		Expect(reporterNetwork(net.ParseIP("2001:db8:1:2::1"))).To(Equal(reporterNetwork(net.ParseIP("2001:db8:1:3::1"))))
+		Expect(reporterNetwork(net.ParseIP("2001:db8:1:2::1"))).ToNot(Equal(reporterNetwork(net.ParseIP("2001:db8:2::1"))))
+	})
+
+	It("Should only demote a server for the reporting network", func() {
+		for i := 0; i < 10; i++ {
+			store.record(input, reporters[i%len(reporters)], Feedback{Host: server.Host, Failed: true}, 0)
+		}
+
+		other := RuleInput{
+			ASN: db.ASN{AutonomousSystemNumber: 64513},
+			Location: db.City{
+				Country: db.Country{IsoCode: "FR"},
+			},
+		}
+
+		Expect(store.demoted(server, other)).To(BeFalse())
+	})
+
+	It("Should reduce the weight of slow servers", func() {
+		for i := 0; i < 10; i++ {
+			store.record(input, reporters[i%len(reporters)], Feedback{Host: server.Host, Throughput: 1024}, 4096)
+		}
+
+		Expect(store.demoted(server, input)).To(BeFalse())
+		Expect(store.weight(server, input)).To(BeNumerically("<", 10))
+	})
+
+	It("Should rate limit clients", func() {
+		Expect(store.allow("192.0.2.1", 2)).To(BeTrue())
+		Expect(store.allow("192.0.2.1", 2)).To(BeTrue())
+		Expect(store.allow("192.0.2.1", 2)).To(BeFalse())
+		Expect(store.allow("192.0.2.2", 2)).To(BeTrue())
+	})
+
+	It("Should verify signatures", func() {
+		body := []byte(`{"host":"mirror.example.com","failed":true}`)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		signature := hex.EncodeToString(mac.Sum(nil))
+
+		Expect(validFeedbackSignature("secret", body, "sha256="+signature)).To(BeTrue())
+		Expect(validFeedbackSignature("secret", body, signature)).To(BeTrue())
+		Expect(validFeedbackSignature("other", body, signature)).To(BeFalse())
+		Expect(validFeedbackSignature("secret", body, "invalid")).To(BeFalse())
+	})
+})
@@ -0,0 +1,36 @@
+package redirector
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HEAD of mapped files", func() {
+	It("Should answer with the file metadata and the chosen mirror", func() {
+		r := New(&Config{})
+
+		file := &ReleaseFile{
+			FileURL:     "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+			FileURLSHA:  "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz.sha",
+			FileUpdated: "2024-05-28T10:00:00Z",
+			FileSize:    "1073741824",
+		}
+
+		r.checksums.sums[file.FileURLSHA] = testChecksum
+
+		w := httptest.NewRecorder()
+		r.mappedHeadHandler(w, redirectTarget{
+			URL:  "https://imola.armbian.com/dl/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+			File: file,
+		})
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Length")).To(Equal("1073741824"))
+		Expect(w.Header().Get("Last-Modified")).To(Equal("Tue, 28 May 2024 10:00:00 GMT"))
+		Expect(w.Header().Get("Location")).To(Equal("https://imola.armbian.com/dl/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz"))
+		Expect(w.Header().Get("Content-Digest")).To(Equal("sha-256=:n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=:"))
+	})
+})
@@ -1,17 +1,22 @@
 package redirector
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/armbian/redirector/db"
 	"github.com/jmcvetta/randutil"
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,16 +29,15 @@ func (r *Redirector) statusHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// redirectHandler is the default "not found" handler which handles redirects
-// if the environment variable OVERRIDE_IP is set, it will use that ip address
+// clientIP returns the ip address of the client.
+// if the environment variable OVERRIDE_IP is set, it will use that ip address for local clients
 // this is useful for local testing when you're on the local network
-func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
+func clientIP(req *http.Request) (net.IP, error) {
 	ipStr, _, err := net.SplitHostPort(req.RemoteAddr)
 
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "remote": req.RemoteAddr}).Warning("Unable to parse host/port from request")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	ip := net.ParseIP(ipStr)
@@ -48,9 +52,83 @@ func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
 		ip = net.ParseIP(overrideIP)
 	}
 
+	return ip, nil
+}
+
+// requestScheme returns the scheme the client used, which is set by the real ip middleware.
+func requestScheme(req *http.Request) string {
+	// If we don't have a scheme, we'll use http by default
+	if req.URL.Scheme == "" {
+		return "http"
+	}
+
+	return req.URL.Scheme
+}
+
+// isIPv6 returns true if the ip is an IPv6 address.
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
+}
+
+// queryInt parses an integer query parameter, limited to 1 through max.
+func queryInt(req *http.Request, key string, def, max int) int {
+	v, err := strconv.Atoi(req.URL.Query().Get(key))
+
+	if err != nil || v < 1 {
+		return def
+	}
+
+	if v > max {
+		return max
+	}
+
+	return v
+}
+
+// redirectHandler is the default "not found" handler which handles redirects
+func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Metalinks of mapped images list several mirrors instead of redirecting to one
+	if key, ok := strings.CutSuffix(strings.TrimLeft(req.URL.Path, "/"), metalinkExtension); ok {
+		if dm := r.dlMap.Load(); dm != nil && dm.Files[key] != nil {
+			r.metalinkHandler(w, req, ip, key, dm.Files[key])
+			return
+		}
+	}
+
+	// Torrents of mapped images get the closest mirrors as web seeds
+	if key, ok := strings.CutSuffix(strings.TrimLeft(req.URL.Path, "/"), torrentExtension); ok && r.config.DynamicTorrents {
+		if dm := r.dlMap.Load(); dm != nil && dm.Files[key] != nil && dm.Files[key].FileURLTorrent != "" {
+			if r.torrentHandler(w, req, ip, key, dm.Files[key]) {
+				return
+			}
+		}
+	}
+
+	// Browsers get a landing page for mapped images instead of a plain redirect
+	if r.config.LandingPages && req.Method == http.MethodGet && !req.URL.Query().Has(landingDownloadParam) {
+		if dm := r.dlMap.Load(); dm != nil && dm.Files[strings.TrimLeft(req.URL.Path, "/")] != nil {
+			w.Header().Add("Vary", "Accept")
+
+			if prefersHTML(req) {
+				r.landingHandler(w, req, ip, strings.TrimLeft(req.URL.Path, "/"), dm)
+				return
+			}
+		}
+	}
+
 	var server *Server
 	var distance float64
 
+	// Clients retrying a failed download pass back the hosts that failed them
+	exclude := r.excludedHosts(req, ip)
+
 	// If the path has a prefix of region/NA, it will use specific regions instead
 	// of the default geographical distance
 	if strings.HasPrefix(req.URL.Path, "/region/") {
@@ -65,12 +143,12 @@ func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
 			choices := make([]randutil.Choice, len(mirrors))
 
 			for i, item := range mirrors {
-				if !item.Available {
+				if !item.Available || item.overBudget() || lo.ContainsBy(exclude, item.hasHost) {
 					continue
 				}
 
 				choices[i] = randutil.Choice{
-					Weight: item.Weight,
+					Weight: item.effectiveWeight(),
 					Item:   item,
 				}
 			}
@@ -89,19 +167,14 @@ func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// If we don't have a scheme, we'll use http by default
-	scheme := req.URL.Scheme
-
-	if scheme == "" {
-		scheme = "http"
-	}
+	scheme := requestScheme(req)
 
 	// Detect if user is connecting via IPv6
-	isIPv6 := ip.To4() == nil && ip.To16() != nil
+	isIPv6 := isIPv6(ip)
 
 	// If none of the above exceptions are matched, we use the geographical distance based on IP
 	if server == nil {
-		server, distance, err = r.servers.Closest(r, scheme, ip, isIPv6)
+		server, distance, err = r.servers.Closest(r, scheme, ip, isIPv6, exclude)
 
 		if err != nil {
 			log.WithError(err).Warning("Unable to find closest server")
@@ -110,17 +183,105 @@ func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	target := r.resolve(server, scheme, req.URL.Path, isIPv6)
+
+	// HEAD requests of mapped files are answered from the map metadata, without a redirect
+	if req.Method == http.MethodHead && target.File != nil {
+		r.mappedHeadHandler(w, target)
+		return
+	}
+
+	if target.Mapped {
+		downloadsMapped.Inc()
+	}
+
+	server.Redirects.Inc()
+	redirectsServed.Inc()
+
+	// Mapped downloads served by the mirror count towards its monthly budget
+	if !target.External && target.File != nil {
+		server.addUsage(target.File.Size())
+	}
+
+	// If we used geographical distance, we add an X-Geo-Distance header for debug.
+	if distance > 0 {
+		w.Header().Set("X-Geo-Distance", fmt.Sprintf("%f", distance))
+	}
+
+	if r.config.LinkHeaders > 0 {
+		r.addLinkHeaders(w, req, server, target, scheme, ip, isIPv6, exclude)
+	}
+
+	if r.config.DigestHeaders && target.File != nil {
+		r.addDigestHeaders(w, target.File)
+	}
+
+	w.Header().Set("Location", target.URL)
+	w.WriteHeader(http.StatusFound)
+}
+
+// redirectTarget is a request path resolved against a server.
+type redirectTarget struct {
+	// URL is the final url to redirect to.
+	URL string
+
+	// Mapped is true if the path was found in the download map.
+	Mapped bool
+
+	// External is true if the mapped path is not hosted on the server (Github or a full link).
+	External bool
+
+	// File is the mapped asset, if the path is a mapped image.
+	File *ReleaseFile
+}
+
+// rankedTarget is a ranked server with the target of a path on it.
+type rankedTarget struct {
+	Server *Server
+	Target redirectTarget
+}
+
+// rankedURLs resolves a path on the ranked servers, returning up to n targets with distinct urls.
+// Files hosted outside the mirrors have the same url everywhere, so they are only listed once.
+func (r *Redirector) rankedURLs(ranked []ComputedDistance, scheme, requestPath string, ipv6 bool, n int) []rankedTarget {
+	var targets []rankedTarget
+
+	for _, item := range ranked {
+		if len(targets) >= n {
+			break
+		}
+
+		target := r.resolve(item.Server, scheme, requestPath, ipv6)
+
+		if lo.ContainsBy(targets, func(t rankedTarget) bool { return t.Target.URL == target.URL }) {
+			continue
+		}
+
+		targets = append(targets, rankedTarget{Server: item.Server, Target: target})
+	}
+
+	return targets
+}
+
+// resolve builds the final url of a request path on a server.
+// Paths in the download map are mapped to their final path, and the server's rewrites are applied.
+func (r *Redirector) resolve(server *Server, scheme, requestPath string, ipv6 bool) redirectTarget {
+	var target redirectTarget
+
 	// redirectPath is a combination of server path (which can be something like /armbian)
 	// and the URL path.
 	// Example: /armbian + /some/path = /armbian/some/path
-	redirectPath := path.Join(server.Path, req.URL.Path)
+	redirectPath := path.Join(server.Path, requestPath)
 
 	// If we have a dlMap, we map the url to a final path instead
 	var isGithub bool
 	var isLink bool
-	if r.dlMap != nil {
-		if newPath, exists := r.dlMap[strings.TrimLeft(req.URL.Path, "/")]; exists {
-			downloadsMapped.Inc()
+	if dm := r.dlMap.Load(); dm != nil {
+		key := strings.TrimLeft(requestPath, "/")
+
+		if newPath, exists := dm.Paths[key]; exists {
+			target.Mapped = true
+			target.File = dm.Files[key]
 
 			// OS, community and distribution images are hosted at Github
 			if strings.Contains(newPath, "/armbian/") {
@@ -135,40 +296,135 @@ func (r *Redirector) redirectHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if strings.HasSuffix(req.URL.Path, "/") && !strings.HasSuffix(redirectPath, "/") {
+	target.External = isGithub || isLink
+
+	// Mirrors with a different layout rewrite the final path
+	if !target.External {
+		redirectPath = server.rewrite(redirectPath)
+	}
+
+	if strings.HasSuffix(requestPath, "/") && !strings.HasSuffix(redirectPath, "/") {
 		redirectPath += "/"
 	}
 
-	var u *url.URL
-	if !isLink {
-		// We need to build the final url now
-		u = &url.URL{
-			Scheme: scheme,
-			Host:   server.Host,
-			Path:   redirectPath,
-		}
+	if isLink {
+		target.URL = redirectPath
+		return target
+	}
+
+	// We need to build the final url now
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   server.hostFor(ipv6),
+		Path:   redirectPath,
+	}
+
+	// Some images are hosted at Github, we have to redirect them to the correct URL
+	if isGithub {
+		u.Host = "github.com"
+	}
+
+	target.URL = u.String()
+
+	return target
+}
+
+// mappedHeadHandler answers a HEAD request of a mapped file with its size, modification time
+// and checksum from the download map, along with the Location of the chosen mirror.
+func (r *Redirector) mappedHeadHandler(w http.ResponseWriter, target redirectTarget) {
+	file := target.File
+
+	contentType := mime.TypeByExtension(path.Ext(file.FileURL))
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	if size := file.Size(); size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	if updated, err := time.Parse(time.RFC3339, file.FileUpdated); err == nil {
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+
+	r.addDigestHeaders(w, file)
+
+	w.Header().Set("Location", target.URL)
+	w.WriteHeader(http.StatusOK)
+}
+
+// exclusionReports is the number of client and host pairs remembered to count exclusions once.
+const exclusionReports = 16384
+
+// excludedHosts parses the exclude query parameter, which is a comma separated list
+// of hosts that already failed for the client. Each known host is counted as a failure
+// at most once per client, so a single client can't inflate the failures of a mirror.
+func (r *Redirector) excludedHosts(req *http.Request, ip net.IP) []string {
+	var exclude []string
+
+	for _, value := range req.URL.Query()["exclude"] {
+		for _, host := range strings.Split(value, ",") {
+			host = strings.TrimSpace(host)
+
+			if host == "" || lo.Contains(exclude, host) {
+				continue
+			}
+
+			exclude = append(exclude, host)
+
+			server, ok := r.hostMap[host]
+
+			if !ok || server.Failures == nil {
+				continue
+			}
 
-		// Some images are hosted at Github, we have to redirect them to the correct URL
-		if isGithub {
-			u.Host = "github.com"
+			if r.exclusions != nil {
+				if seen, _ := r.exclusions.ContainsOrAdd(ip.String()+"|"+server.Host, struct{}{}); seen {
+					continue
+				}
+			}
+
+			server.Failures.Inc()
 		}
 	}
 
-	server.Redirects.Inc()
-	redirectsServed.Inc()
+	if len(exclude) > 0 {
+		retriesServed.Inc()
+	}
 
-	// If we used geographical distance, we add an X-Geo-Distance header for debug.
-	if distance > 0 {
-		w.Header().Set("X-Geo-Distance", fmt.Sprintf("%f", distance))
+	return exclude
+}
+
+// etagMatches returns true if the If-None-Match header of the request matches the etag, using weak comparison.
+func etagMatches(req *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, match := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+
+		if match == etag || match == "*" {
+			return true
+		}
 	}
 
-	path := redirectPath
-	if !isLink && u != nil {
-		path = u.String()
+	return false
+}
+
+// hasBearerToken returns true if the request is authorized with the token in `Authorization: Bearer TOKEN`.
+// An empty token never matches.
+func hasBearerToken(req *http.Request, expected string) bool {
+	token := req.Header.Get("Authorization")
+
+	if expected == "" || token == "" || !strings.HasPrefix(token, "Bearer") || !strings.Contains(token, " ") {
+		return false
 	}
 
-	w.Header().Set("Location", path)
-	w.WriteHeader(http.StatusFound)
+	token = token[strings.Index(token, " ")+1:]
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
 }
 
 // reloadHandler is an http handler which lets us reload the server configuration
@@ -179,16 +435,7 @@ func (r *Redirector) reloadHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token := req.Header.Get("Authorization")
-
-	if token == "" || !strings.HasPrefix(token, "Bearer") || !strings.Contains(token, " ") {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	token = token[strings.Index(token, " ")+1:]
-
-	if token != r.config.ReloadToken {
+	if !hasBearerToken(req, r.config.ReloadToken) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -203,15 +450,27 @@ func (r *Redirector) reloadHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// dlMapHandler returns the paths of the download map.
+// With ?diagnostics=true, the generated aliases and their collisions are returned along with the paths.
 func (r *Redirector) dlMapHandler(w http.ResponseWriter, req *http.Request) {
-	if r.dlMap == nil {
+	dm := r.dlMap.Load()
+
+	if dm == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	json.NewEncoder(w).Encode(r.dlMap)
+	if diagnostics, _ := strconv.ParseBool(req.URL.Query().Get("diagnostics")); diagnostics {
+		json.NewEncoder(w).Encode(map[string]any{
+			"paths":   dm.Paths,
+			"aliases": dm.Aliases,
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(dm.Paths)
 }
 
 func (r *Redirector) geoIPHandler(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,126 @@
+package redirector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ImageEntry is an image returned by the images api.
+type ImageEntry struct {
+	*Image
+
+	// URL is the redirector url of the image.
+	URL string `json:"url"`
+
+	// Companions maps companion extensions (asc, sha, torrent) to their redirector urls.
+	Companions map[string]string `json:"companions,omitempty"`
+}
+
+// newImageEntry creates the entry of an image, with urls relative to the redirector base url.
+func newImageEntry(image *Image, base string) ImageEntry {
+	entry := ImageEntry{
+		Image: image,
+		URL:   base + image.Key,
+	}
+
+	if len(image.Companions) > 0 {
+		entry.Companions = make(map[string]string, len(image.Companions))
+
+		for ext, key := range image.Companions {
+			entry.Companions[strings.TrimPrefix(ext, ".")] = base + key
+		}
+	}
+
+	return entry
+}
+
+// imageFilter matches images against the query parameters of the images api.
+type imageFilter struct {
+	board    string
+	distro   string
+	branch   string
+	variant  string
+	promoted *bool
+}
+
+// newImageFilter parses the filter query parameters.
+func newImageFilter(query url.Values) (imageFilter, error) {
+	filter := imageFilter{
+		board:   query.Get("board"),
+		distro:  query.Get("distro"),
+		branch:  query.Get("branch"),
+		variant: query.Get("variant"),
+	}
+
+	if v := query.Get("promoted"); v != "" {
+		promoted, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return filter, err
+		}
+
+		filter.promoted = &promoted
+	}
+
+	return filter, nil
+}
+
+// match returns true if the image matches every set filter. String filters are case-insensitive.
+func (f imageFilter) match(image *Image) bool {
+	if f.board != "" && !strings.EqualFold(f.board, image.Board) {
+		return false
+	}
+
+	if f.distro != "" && !strings.EqualFold(f.distro, image.Distro) {
+		return false
+	}
+
+	if f.branch != "" && !strings.EqualFold(f.branch, image.Branch) {
+		return false
+	}
+
+	if f.variant != "" && !strings.EqualFold(f.variant, image.Variant) {
+		return false
+	}
+
+	if f.promoted != nil && *f.promoted != image.Promoted {
+		return false
+	}
+
+	return true
+}
+
+// imagesHandler returns the images of the download map, filtered by board, distro, branch, variant and promoted.
+func (r *Redirector) imagesHandler(w http.ResponseWriter, req *http.Request) {
+	dm := r.dlMap.Load()
+
+	if dm == nil {
+		http.Error(w, "No download map loaded", http.StatusNotFound)
+		return
+	}
+
+	filter, err := newImageFilter(req.URL.Query())
+
+	if err != nil {
+		http.Error(w, "Invalid promoted value", http.StatusBadRequest)
+		return
+	}
+
+	base := requestScheme(req) + "://" + req.Host + "/"
+
+	images := make([]ImageEntry, 0)
+
+	for _, image := range dm.Images {
+		if !filter.match(image) {
+			continue
+		}
+
+		images = append(images, newImageEntry(image, base))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
@@ -0,0 +1,156 @@
+package redirector
+
+import (
+	_ "embed"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/armbian/redirector/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultLandingMirrors is the number of mirrors listed on landing pages.
+const defaultLandingMirrors = 5
+
+// landingDownloadParam is the query parameter of the download link on landing pages,
+// which skips the landing page, so the download is redirected and counted like any other.
+const landingDownloadParam = "download"
+
+var (
+	//go:embed assets/landing.html
+	landingHTML string
+
+	landingTemplate = template.Must(template.New("landing").Parse(landingHTML))
+)
+
+// landingPage is the data of an image landing page.
+type landingPage struct {
+	Title      string
+	Name       string
+	Image      *Image
+	Size       string
+	Checksum   string
+	Download   string
+	Companions []landingLink
+	Mirrors    []landingMirror
+}
+
+// landingLink is a companion file link on a landing page.
+type landingLink struct {
+	Name string
+	URL  string
+}
+
+// landingMirror is an alternative mirror on a landing page.
+type landingMirror struct {
+	Host    string
+	Country string
+	URL     string
+}
+
+// prefersHTML returns true if the Accept header of the request prefers text/html over any other type.
+// Clients like curl, wget and apt send */* or no Accept header at all, and keep getting redirects.
+func prefersHTML(req *http.Request) bool {
+	var html, other float64
+
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			html = max(html, q)
+		default:
+			other = max(other, q)
+		}
+	}
+
+	return html > 0 && html >= other
+}
+
+// landingHandler renders the landing page of a mapped image for browsers, with its metadata,
+// verification files and the client's closest mirrors. The download starts with a redirect to the closest mirror.
+func (r *Redirector) landingHandler(w http.ResponseWriter, req *http.Request, ip net.IP, key string, dm *DownloadMap) {
+	scheme := requestScheme(req)
+	ipv6 := isIPv6(ip)
+	file := dm.Files[key]
+
+	image := newImage(key, file)
+
+	page := landingPage{
+		Title: imageTitle(image),
+		Name:  path.Base(file.FileURL),
+		Image: image,
+	}
+
+	if size := file.Size(); size > 0 {
+		page.Size = util.FormatSize(size)
+	}
+
+	if file.FileURLSHA != "" {
+		page.Checksum, _ = r.checksums.peek(file.FileURLSHA)
+	}
+
+	for _, ext := range extensionFormats {
+		if dm.Paths[key+ext] != "" {
+			page.Companions = append(page.Companions, landingLink{
+				Name: page.Name + ext,
+				URL:  "/" + key + ext,
+			})
+		}
+	}
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers for landing page")
+	}
+
+	for _, item := range r.rankedURLs(ranked, scheme, key, ipv6, defaultLandingMirrors) {
+		mirror := landingMirror{
+			Host: item.Server.Host,
+			URL:  item.Target.URL,
+		}
+
+		if u, err := url.Parse(item.Target.URL); err == nil {
+			mirror.Host = u.Host
+		}
+
+		if !item.Target.External {
+			mirror.Country = item.Server.Country
+		}
+
+		page.Mirrors = append(page.Mirrors, mirror)
+	}
+
+	// The download goes through the redirector, so it is only counted when it starts
+	if len(page.Mirrors) > 0 {
+		page.Download = "/" + key + "?" + landingDownloadParam + "=1"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if err := landingTemplate.Execute(w, page); err != nil {
+		log.WithError(err).Warning("Unable to render landing page")
+	}
+}
@@ -0,0 +1,123 @@
+package redirector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Landing", func() {
+	DescribeTable("Should detect browsers by their Accept header",
+		func(accept string, expected bool) {
+			req := httptest.NewRequest("GET", "/orangepi5/Bookworm_current_minimal", nil)
+
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+
+			Expect(prefersHTML(req)).To(Equal(expected))
+		},
+		Entry("Firefox", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8", true),
+		Entry("Chrome", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7", true),
+		Entry("curl", "*/*", false),
+		Entry("apt", "", false),
+		Entry("JSON client", "application/json, text/html;q=0.5", false),
+	)
+
+	It("Should render the image details and mirrors", func() {
+		image := &Image{
+			Board:   "orangepi5",
+			Distro:  "bookworm",
+			Branch:  "current",
+			Variant: "minimal",
+			Updated: time.Date(2024, 5, 28, 10, 0, 0, 0, time.UTC),
+		}
+
+		var buf bytes.Buffer
+
+		err := landingTemplate.Execute(&buf, landingPage{
+			Title:      imageTitle(image),
+			Name:       "Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+			Image:      image,
+			Size:       "1.0 GiB",
+			Download:   "https://imola.armbian.com/dl/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+			Companions: []landingLink{{Name: "Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz.sha", URL: "/orangepi5/Bookworm_current_minimal.sha"}},
+			Mirrors:    []landingMirror{{Host: "imola.armbian.com", Country: "IT", URL: "https://imola.armbian.com/dl/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz"}},
+		})
+
+		Expect(err).To(BeNil())
+		Expect(buf.String()).To(ContainSubstring(`<meta http-equiv="refresh" content="2;url=https://imola.armbian.com/dl/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz">`))
+		Expect(buf.String()).To(ContainSubstring(`<a href="/orangepi5/Bookworm_current_minimal.sha">`))
+		Expect(buf.String()).To(ContainSubstring("imola.armbian.com</a> (IT)"))
+		Expect(buf.String()).To(ContainSubstring("2024-05-28 10:00 UTC"))
+	})
+
+	Context("Requests", func() {
+		var r *Redirector
+
+		BeforeEach(func() {
+			r = newGeoRedirector()
+			r.config.LandingPages = true
+
+			for _, server := range r.servers {
+				server.Redirects = prometheus.NewCounter(prometheus.CounterOpts{Name: "redirects"})
+			}
+
+			r.dlMap.Store(&DownloadMap{
+				Paths: map[string]string{"orangepi5/Bookworm_current_minimal": "dl/orangepi5/archive/Armbian.img.xz"},
+				Files: map[string]*ReleaseFile{"orangepi5/Bookworm_current_minimal": {
+					FileURL:  "https://dl.armbian.com/orangepi5/archive/Armbian.img.xz",
+					FileSize: "1024",
+				}},
+			})
+		})
+
+		get := func(url string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", url, nil)
+			req.RemoteAddr = berlinClient + ":1234"
+			req.Header.Set("Accept", "text/html")
+
+			w := httptest.NewRecorder()
+			r.redirectHandler(w, req)
+
+			return w
+		}
+
+		It("Should not count rendering the page as a redirect", func() {
+			w := get("/orangepi5/Bookworm_current_minimal")
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`<meta http-equiv="refresh" content="2;url=/orangepi5/Bookworm_current_minimal?download=1">`))
+			Expect(w.Body.String()).To(ContainSubstring("berlin.example.com</a> (DE)"))
+
+			for _, server := range r.servers {
+				Expect(counterValue(server.Redirects)).To(BeZero())
+			}
+		})
+
+		It("Should not offer a download without mirrors", func() {
+			for _, server := range r.servers {
+				server.Available = false
+			}
+
+			w := get("/orangepi5/Bookworm_current_minimal")
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring("No mirror is currently available"))
+			Expect(w.Body.String()).ToNot(ContainSubstring("?download=1"))
+		})
+
+		It("Should redirect the download to the closest mirror", func() {
+			w := get("/orangepi5/Bookworm_current_minimal?download=1")
+
+			Expect(w.Code).To(Equal(http.StatusFound))
+			Expect(w.Header().Get("Location")).To(Equal("http://berlin.example.com/apt/dl/orangepi5/archive/Armbian.img.xz"))
+			Expect(counterValue(r.servers[0].Redirects)).To(Equal(1.0))
+		})
+	})
+})
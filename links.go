@@ -0,0 +1,108 @@
+package redirector
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+// addLinkHeaders adds RFC 6249 Link headers for the next-best mirrors after the chosen server,
+// so clients supporting them can fail over on their own.
+func (r *Redirector) addLinkHeaders(w http.ResponseWriter, req *http.Request, chosen *Server, target redirectTarget, scheme string, ip net.IP, ipv6 bool, exclude []string) {
+	// External files have the same url on every mirror, so there is no alternative to link
+	if target.External {
+		return
+	}
+
+	ranked, err := r.alternates(scheme, ip, ipv6, exclude)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers for link headers")
+		return
+	}
+
+	pri := 0
+
+	// One more than needed, in case the chosen server is among them
+	for _, item := range r.rankedURLs(ranked, scheme, req.URL.Path, ipv6, r.config.LinkHeaders+1) {
+		if pri >= r.config.LinkHeaders {
+			break
+		}
+
+		if item.Server == chosen || item.Target.URL == target.URL {
+			continue
+		}
+
+		pri++
+
+		link := "<" + item.Target.URL + ">; rel=duplicate; pri=" + strconv.Itoa(pri)
+
+		if item.Server.Country != "" {
+			link += "; geo=" + strings.ToLower(item.Server.Country)
+		}
+
+		w.Header().Add("Link", link)
+	}
+}
+
+// alternates returns the ranked servers of a client for Link headers. Like the choice of Closest,
+// the ranking is cached per client unless hosts are excluded, and servers which became unusable are skipped.
+func (r *Redirector) alternates(scheme string, ip net.IP, ipv6 bool, exclude []string) ([]ComputedDistance, error) {
+	cacheKey := "rank_" + closestCacheKey(scheme, ip, ipv6)
+	useCache := len(exclude) == 0 && r.serverCache != nil
+
+	if useCache {
+		if cached, exists := r.serverCache.Get(cacheKey); exists {
+			if ranked, ok := cached.([]ComputedDistance); ok {
+				return lo.Filter(ranked, func(item ComputedDistance, _ int) bool {
+					return item.Server.Available && !item.Server.overBudget()
+				}), nil
+			}
+		}
+	}
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, exclude)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if useCache {
+		r.serverCache.Add(cacheKey, ranked)
+	}
+
+	return ranked, nil
+}
+
+// addDigestHeaders adds the SHA-256 checksum of a mapped file as Digest (RFC 3230)
+// and Content-Digest (RFC 9530) headers, if the checksum is loaded. Otherwise, it is loaded
+// in the background for the next requests.
+func (r *Redirector) addDigestHeaders(w http.ResponseWriter, file *ReleaseFile) {
+	if file.FileURLSHA == "" {
+		return
+	}
+
+	sum, ok := r.checksums.peek(file.FileURLSHA)
+
+	if !ok {
+		r.checksums.load(file.FileURLSHA)
+		return
+	}
+
+	b, err := hex.DecodeString(sum)
+
+	if err != nil {
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(b)
+
+	w.Header().Set("Digest", "SHA-256="+encoded)
+	w.Header().Set("Content-Digest", "sha-256=:"+encoded+":")
+}
@@ -0,0 +1,94 @@
+package redirector
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Digest headers", func() {
+	var (
+		r    *Redirector
+		file *ReleaseFile
+	)
+
+	BeforeEach(func() {
+		r = New(&Config{DigestHeaders: true})
+		file = &ReleaseFile{FileURLSHA: "https://dl.example.com/Armbian.img.xz.sha"}
+	})
+
+	It("Should add digest headers for loaded checksums", func() {
+		r.checksums.sums[file.FileURLSHA] = testChecksum
+
+		w := httptest.NewRecorder()
+		r.addDigestHeaders(w, file)
+
+		Expect(w.Header().Get("Digest")).To(Equal("SHA-256=n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="))
+		Expect(w.Header().Get("Content-Digest")).To(Equal("sha-256=:n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=:"))
+	})
+
+	It("Should load unknown checksums in the background", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(testChecksum + "  Armbian.img.xz\n"))
+		}))
+		defer server.Close()
+
+		file.FileURLSHA = server.URL + "/Armbian.img.xz.sha"
+
+		w := httptest.NewRecorder()
+		r.addDigestHeaders(w, file)
+
+		Expect(w.Header().Get("Digest")).To(BeEmpty())
+		Expect(w.Header().Get("Content-Digest")).To(BeEmpty())
+
+		Eventually(func() bool {
+			_, ok := r.checksums.peek(file.FileURLSHA)
+			return ok
+		}).Should(BeTrue())
+	})
+})
+
+var _ = Describe("Link headers", func() {
+	var r *Redirector
+
+	BeforeEach(func() {
+		r = newGeoRedirector()
+		r.config.LinkHeaders = 3
+	})
+
+	links := func(exclude []string) []string {
+		req := httptest.NewRequest("GET", "/dists/bookworm/InRelease", nil)
+		target := r.resolve(r.servers[0], "https", req.URL.Path, false)
+
+		w := httptest.NewRecorder()
+		r.addLinkHeaders(w, req, r.servers[0], target, "https", net.ParseIP(berlinClient), false, exclude)
+
+		return w.Header().Values("Link")
+	}
+
+	It("Should list the next mirrors, closest first", func() {
+		Expect(links(nil)).To(Equal([]string{
+			"<https://munich.example.com/apt/dists/bookworm/InRelease>; rel=duplicate; pri=1; geo=de",
+			"<https://paris.example.com/apt/dists/bookworm/InRelease>; rel=duplicate; pri=2; geo=fr",
+		}))
+	})
+
+	It("Should cache the ranking, skipping servers which became unavailable", func() {
+		Expect(links(nil)).To(HaveLen(2))
+		Expect(r.serverCache.Contains("rank_https_" + berlinClient)).To(BeTrue())
+
+		r.servers[1].Available = false
+
+		Expect(links(nil)).To(Equal([]string{
+			"<https://paris.example.com/apt/dists/bookworm/InRelease>; rel=duplicate; pri=1; geo=fr",
+		}))
+	})
+
+	It("Should not cache rankings with excluded hosts", func() {
+		Expect(links([]string{"paris.example.com"})).To(HaveLen(1))
+		Expect(r.serverCache.Len()).To(BeZero())
+	})
+})
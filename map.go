@@ -7,7 +7,9 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,10 +20,90 @@ import (
 
 // ErrUnsupportedFormat is returned when an unsupported map format is used.
 var ErrUnsupportedFormat = errors.New("unsupported map format")
+
+// ErrEmptyMap is returned when a download map has no entries, like a file truncated while being written.
+var ErrEmptyMap = errors.New("download map is empty")
+
 var extensionFormats = []string{".asc", ".sha", ".torrent"}
 
-// loadMapFile loads a file as a map
-func loadMapFile(file string, specialExtensions map[string]string) (map[string]string, error) {
+// DownloadMap is a parsed download map.
+type DownloadMap struct {
+	// Paths maps request paths to the path or url they are redirected to.
+	Paths map[string]string
+
+	// Files maps request paths of images to the asset they were generated from.
+	Files map[string]*ReleaseFile
+
+	// Images holds the parsed assets as structured records, in the order of the map file.
+	Images []*Image
+
+	// Aliases holds the generated alias keys and how their collisions were resolved.
+	Aliases []*MapAlias
+}
+
+// validate checks a loaded map before it replaces the current one.
+func (dm *DownloadMap) validate() error {
+	if len(dm.Paths) == 0 {
+		return ErrEmptyMap
+	}
+
+	return nil
+}
+
+// Image is a structured record of a mapped image asset.
+type Image struct {
+	// Key is the request path the image is mapped to.
+	Key         string    `json:"key"`
+	Board       string    `json:"board"`
+	Version     string    `json:"version,omitempty"`
+	Distro      string    `json:"distro"`
+	Branch      string    `json:"branch"`
+	Variant     string    `json:"variant"`
+	Application string    `json:"application,omitempty"`
+	Promoted    bool      `json:"promoted"`
+	Repository  string    `json:"repository"`
+	Extension   string    `json:"extension"`
+	Size        int64     `json:"size"`
+	Updated     time.Time `json:"updated"`
+
+	// Companions maps companion extensions (.asc, .sha, .torrent) to their request path.
+	Companions map[string]string `json:"-"`
+
+	File *ReleaseFile `json:"-"`
+
+	// prefix and suffix surround the board/distro_branch_variant part of the key, and are kept on aliases.
+	prefix string
+	suffix string
+}
+
+// newImage creates the structured record of an asset mapped to key.
+func newImage(key string, file *ReleaseFile) *Image {
+	image := &Image{
+		Key:         key,
+		Board:       file.BoardSlug,
+		Version:     file.Version,
+		Distro:      file.DistroRelease,
+		Branch:      file.KernelBranch,
+		Variant:     file.ImageVariant,
+		Application: file.Preinstalled,
+		Repository:  file.Repository,
+		Extension:   file.Extension,
+		Size:        file.Size(),
+		Companions:  make(map[string]string),
+		File:        file,
+	}
+
+	image.Promoted, _ = strconv.ParseBool(file.Promoted)
+
+	if updated, err := time.Parse(time.RFC3339, file.FileUpdated); err == nil {
+		image.Updated = updated
+	}
+
+	return image
+}
+
+// loadMapFile loads a file as a map, in JSON or CSV format
+func loadMapFile(file string, config *Config) (*DownloadMap, error) {
 	f, err := os.Open(file)
 
 	if err != nil {
@@ -30,11 +112,16 @@ func loadMapFile(file string, specialExtensions map[string]string) (map[string]s
 
 	defer f.Close()
 
-	ext := path.Ext(file)
+	return loadMap(f, path.Ext(file), config)
+}
 
+// loadMap loads a map in the format of the file extension, JSON or CSV
+func loadMap(f io.Reader, ext string, config *Config) (*DownloadMap, error) {
 	switch ext {
 	case ".json":
-		return loadMapJSON(f, specialExtensions)
+		return loadMapJSON(f, config.SpecialExtensions, config.MapAliases)
+	case ".csv":
+		return loadMapCSV(f, config.MapColumns, config.SpecialExtensions, config.MapAliases)
 	}
 
 	return nil, ErrUnsupportedFormat
@@ -48,6 +135,7 @@ type Map struct {
 // ReleaseFile represents a file to be mapped
 type ReleaseFile struct {
 	BoardSlug      string `json:"board_slug"`
+	Version        string `json:"armbian_version"`
 	FileURL        string `json:"file_url"`
 	FileURLASC     string `json:"file_url_asc"`
 	FileURLSHA     string `json:"file_url_sha"`
@@ -63,25 +151,46 @@ type ReleaseFile struct {
 	Extension      string `json:"file_extension"`
 }
 
+// Size returns the file size in bytes, or 0 if it is unknown.
+func (f *ReleaseFile) Size() int64 {
+	size, err := strconv.ParseInt(f.FileSize, 10, 64)
+
+	if err != nil || size < 0 {
+		return 0
+	}
+
+	return size
+}
+
 var distroCaser = cases.Title(language.Und)
 
 // loadMapJSON loads a map file from JSON, based on the format specified in the github issue.
+// Alias keys are generated for the images as configured.
 // See: https://github.com/armbian/os/pull/129
-func loadMapJSON(f io.Reader, specialExtensions map[string]string) (map[string]string, error) {
+func loadMapJSON(f io.Reader, specialExtensions map[string]string, aliases MapAliases) (*DownloadMap, error) {
+	var data Map
+
+	if err := json.NewDecoder(f).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return buildMap(data.Assets, specialExtensions, aliases), nil
+}
+
+// buildMap maps the keys of assets to their paths, along with their companion files and aliases.
+func buildMap(assets []ReleaseFile, specialExtensions map[string]string, aliases MapAliases) *DownloadMap {
 	// Avoid panics
 	if specialExtensions == nil {
 		specialExtensions = make(map[string]string)
 	}
 
 	m := make(map[string]string)
+	files := make(map[string]*ReleaseFile)
+	var images []*Image
 
-	var data Map
+	for i := range assets {
+		file := &assets[i]
 
-	if err := json.NewDecoder(f).Decode(&data); err != nil {
-		return nil, err
-	}
-
-	for _, file := range data.Assets {
 		// Because download mapping a full URL, redirecting, and finding a server again is redundant,
 		// we parse the URL and only return the path here. Previously, it would use https://dl.armbian.com/PATH
 		// which is not supported, as the redirector will always prepend a server
@@ -96,9 +205,11 @@ func loadMapJSON(f io.Reader, specialExtensions map[string]string) (map[string]s
 		}
 
 		var sb strings.Builder
+		var prefix string
 
 		if file.Repository == "os" {
-			sb.WriteString("nightly/")
+			prefix = "nightly/"
+			sb.WriteString(prefix)
 		}
 
 		sb.WriteString(file.BoardSlug)
@@ -109,6 +220,8 @@ func loadMapJSON(f io.Reader, specialExtensions map[string]string) (map[string]s
 		sb.WriteString("_")
 		sb.WriteString(file.ImageVariant)
 
+		suffixStart := sb.Len()
+
 		if file.Preinstalled != "" {
 			sb.WriteString("-")
 			sb.WriteString(file.Preinstalled)
@@ -125,10 +238,16 @@ func loadMapJSON(f io.Reader, specialExtensions map[string]string) (map[string]s
 		imageExtensions := maps.Keys(specialExtensions)
 		imageExtensions = append(imageExtensions, "img.xz", "tar.xz") // extra allocation, but it's fine
 
+		image := newImage(sb.String()+"."+file.Extension, file)
+		image.prefix = prefix
+		image.suffix = sb.String()[suffixStart:]
+
 		// Add board into the map without an extension
 		for _, ext := range imageExtensions {
 			if strings.HasSuffix(file.Extension, ext) {
 				m[sb.String()] = u.Path
+				files[sb.String()] = file
+				image.Key = sb.String()
 				break
 			}
 		}
@@ -150,13 +269,27 @@ func loadMapJSON(f io.Reader, specialExtensions map[string]string) (map[string]s
 			}
 
 			m[sb.String()+ext] = filePath
+
+			if filePath != "" {
+				image.Companions[ext] = sb.String() + ext
+			}
 		}
 
 		sb.WriteString(".")
 		sb.WriteString(file.Extension)
 
 		m[sb.String()] = u.Path // Add board into the map with an extension
+		files[sb.String()] = file
+		images = append(images, image)
 	}
 
-	return m, nil
+	dm := &DownloadMap{
+		Paths:  m,
+		Files:  files,
+		Images: images,
+	}
+
+	dm.addAliases(aliases)
+
+	return dm
 }
@@ -0,0 +1,120 @@
+package redirector
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields of plain key,target alias lists.
+const (
+	csvKeyField    = "key"
+	csvTargetField = "target"
+)
+
+// releaseFileFields returns the fields of a release file, by the names of their JSON fields.
+func releaseFileFields(f *ReleaseFile) map[string]*string {
+	return map[string]*string{
+		"board_slug":          &f.BoardSlug,
+		"armbian_version":     &f.Version,
+		"file_url":            &f.FileURL,
+		"file_url_asc":        &f.FileURLASC,
+		"file_url_sha":        &f.FileURLSHA,
+		"file_url_torrent":    &f.FileURLTorrent,
+		"file_updated":        &f.FileUpdated,
+		"file_size":           &f.FileSize,
+		"distro":              &f.DistroRelease,
+		"branch":              &f.KernelBranch,
+		"variant":             &f.ImageVariant,
+		"file_application":    &f.Preinstalled,
+		"promoted":            &f.Promoted,
+		"download_repository": &f.Repository,
+		"file_extension":      &f.Extension,
+	}
+}
+
+// loadMapCSV loads a map file from CSV, either as a plain key,target alias list or in the full asset format.
+// Columns are found by their header names, which can be changed with the columns mapping.
+// The asset format needs a header with a file_url column, and is handled the same way as JSON maps.
+// Alias lists without a key and target header use the first two columns.
+func loadMapCSV(f io.Reader, columns map[string]string, specialExtensions map[string]string, aliases MapAliases) (*DownloadMap, error) {
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	column := func(field string) string {
+		if name, ok := columns[field]; ok {
+			return name
+		}
+
+		return field
+	}
+
+	header := make(map[string]int)
+
+	if len(records) > 0 {
+		for i, name := range records[0] {
+			header[strings.TrimSpace(name)] = i
+		}
+	}
+
+	// Full asset format
+	if _, ok := header[column("file_url")]; ok {
+		assets := make([]ReleaseFile, 0, len(records)-1)
+
+		for _, record := range records[1:] {
+			var file ReleaseFile
+
+			for field, value := range releaseFileFields(&file) {
+				if i, ok := header[column(field)]; ok && i < len(record) {
+					*value = strings.TrimSpace(record[i])
+				}
+			}
+
+			assets = append(assets, file)
+		}
+
+		return buildMap(assets, specialExtensions, aliases), nil
+	}
+
+	keyIndex, targetIndex := 0, 1
+
+	if i, ok := header[column(csvKeyField)]; ok {
+		if j, ok := header[column(csvTargetField)]; ok {
+			keyIndex, targetIndex = i, j
+			records = records[1:]
+		}
+	}
+
+	m := make(map[string]string)
+
+	for _, record := range records {
+		if len(record) <= max(keyIndex, targetIndex) {
+			log.WithField("record", record).Warning("Ignoring download map record without key and target")
+			continue
+		}
+
+		key := strings.TrimLeft(strings.TrimSpace(record[keyIndex]), "/")
+		target := strings.TrimSpace(record[targetIndex])
+
+		if key == "" || target == "" {
+			continue
+		}
+
+		m[key] = target
+	}
+
+	return &DownloadMap{
+		Paths: m,
+		Files: make(map[string]*ReleaseFile),
+	}, nil
+}
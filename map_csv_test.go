@@ -0,0 +1,86 @@
+package redirector
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSV map", func() {
+	It("Should load a plain alias list", func() {
+		data := `# key,target
+bananapi/Bookworm_current_server,/bananapi/archive/Armbian_23.11.1_Bananapi_bookworm_current_6.1.63.img.xz
+/region/EU/test , https://example.com/test.img.xz
+incomplete
+`
+
+		m, err := loadMapCSV(strings.NewReader(data), nil, testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths).To(HaveLen(2))
+		Expect(m.Paths["bananapi/Bookworm_current_server"]).To(Equal("/bananapi/archive/Armbian_23.11.1_Bananapi_bookworm_current_6.1.63.img.xz"))
+		Expect(m.Paths["region/EU/test"]).To(Equal("https://example.com/test.img.xz"))
+		Expect(m.Files).To(BeEmpty())
+	})
+
+	It("Should load an alias list with mapped columns", func() {
+		data := `comment,to,from
+first,/target/a.img.xz,a
+second,/target/b.img.xz,b
+`
+
+		m, err := loadMapCSV(strings.NewReader(data), map[string]string{"key": "from", "target": "to"}, testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths).To(Equal(map[string]string{
+			"a": "/target/a.img.xz",
+			"b": "/target/b.img.xz",
+		}))
+	})
+
+	It("Should load the full asset format with companions and special extensions", func() {
+		data := `board_slug,url,sha,file_updated,file_size,distro,branch,variant,promoted,download_repository,file_extension
+khadas-vim4,https://dl.armbian.com/khadas-vim4/archive/Armbian_23.11.1_Khadas-vim4_bookworm_legacy_5.4.180.oowow.img.xz,sha_test_url_vim4,2023-11-30T01:03:05Z,477868032,bookworm,legacy,server,true,archive,oowow.img.xz
+uefi-arm64,https://dl.armbian.com/uefi-arm64/archive/Armbian_24.5.5_Uefi-arm64_bookworm_current_6.6.42_minimal.img.qcow2,sha_test_url_uefi,2024-07-25T18:01:20Z,673315888,bookworm,current,minimal,false,archive,img.qcow2
+`
+
+		m, err := loadMapCSV(strings.NewReader(data), map[string]string{"file_url": "url", "file_url_sha": "sha"}, testExtensions, MapAliases{Promoted: "promoted"})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths["khadas-vim4/Bookworm_legacy_server"]).To(Equal("/khadas-vim4/archive/Armbian_23.11.1_Khadas-vim4_bookworm_legacy_5.4.180.oowow.img.xz"))
+		Expect(m.Paths["khadas-vim4/Bookworm_legacy_server.sha"]).To(Equal("sha_test_url_vim4"))
+		Expect(m.Paths["khadas-vim4/promoted"]).To(Equal("/khadas-vim4/archive/Armbian_23.11.1_Khadas-vim4_bookworm_legacy_5.4.180.oowow.img.xz"))
+		Expect(m.Paths["uefi-arm64/Bookworm_current_minimal-qcow2"]).To(Equal("/uefi-arm64/archive/Armbian_24.5.5_Uefi-arm64_bookworm_current_6.6.42_minimal.img.qcow2"))
+		Expect(m.Paths["uefi-arm64/Bookworm_current_minimal-qcow2.sha"]).To(Equal("sha_test_url_uefi"))
+		Expect(m.Files["uefi-arm64/Bookworm_current_minimal-qcow2"].Size()).To(Equal(int64(673315888)))
+		Expect(m.Images).To(HaveLen(2))
+	})
+
+	It("Should fail on invalid CSV", func() {
+		_, err := loadMapCSV(strings.NewReader("key,\"target\nbroken"), nil, testExtensions, MapAliases{})
+
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Should load map files by their extension", func() {
+		dir := GinkgoT().TempDir()
+
+		csvFile := filepath.Join(dir, "userdata.csv")
+		Expect(os.WriteFile(csvFile, []byte("a,/target/a.img.xz\n"), 0o644)).To(Succeed())
+
+		m, err := loadMapFile(csvFile, &Config{})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths["a"]).To(Equal("/target/a.img.xz"))
+
+		txtFile := filepath.Join(dir, "userdata.txt")
+		Expect(os.WriteFile(txtFile, []byte("a,/target/a.img.xz\n"), 0o644)).To(Succeed())
+
+		_, err = loadMapFile(txtFile, &Config{})
+
+		Expect(err).To(Equal(ErrUnsupportedFormat))
+	})
+})
@@ -1,7 +1,9 @@
 package redirector
 
 import (
+	"net/url"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -38,10 +40,73 @@ var _ = Describe("Map", func() {
 		  ]
 		}`
 
-		m, err := loadMapJSON(strings.NewReader(data), testExtensions)
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
 
 		Expect(err).To(BeNil())
-		Expect(m["aml-s9xx-box/Bookworm_current_server"]).To(Equal("/aml-s9xx-box/archive/Armbian_23.11.1_Aml-s9xx-box_bookworm_current_6.1.63.img.xz"))
+		Expect(m.Paths["aml-s9xx-box/Bookworm_current_server"]).To(Equal("/aml-s9xx-box/archive/Armbian_23.11.1_Aml-s9xx-box_bookworm_current_6.1.63.img.xz"))
+		Expect(m.Files["aml-s9xx-box/Bookworm_current_server"].Size()).To(Equal(int64(566235552)))
+		Expect(m.Files).ToNot(HaveKey("aml-s9xx-box/Bookworm_current_server.sha"))
+
+		Expect(m.Images).To(HaveLen(1))
+		Expect(m.Images[0].Key).To(Equal("aml-s9xx-box/Bookworm_current_server"))
+		Expect(m.Images[0].Board).To(Equal("aml-s9xx-box"))
+		Expect(m.Images[0].Version).To(Equal("23.11.1"))
+		Expect(m.Images[0].Promoted).To(BeTrue())
+		Expect(m.Images[0].Updated).To(Equal(time.Date(2023, 11, 30, 1, 14, 49, 0, time.UTC)))
+		Expect(m.Images[0].Companions).To(BeEmpty())
+	})
+	It("Should filter images of the map", func() {
+		data := `{
+		  "assets": [
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_vendor_6.1.43_minimal.img.xz",
+		      "file_url_sha": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_vendor_6.1.43_minimal.img.xz.sha",
+		      "file_updated": "2024-05-28T10:00:00Z",
+		      "file_size": "1000",
+		      "distro": "bookworm",
+		      "branch": "vendor",
+		      "variant": "minimal",
+		      "promoted": "true",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    },
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_noble_vendor_6.1.43_gnome_desktop.img.xz",
+		      "file_updated": "2024-05-28T11:00:00Z",
+		      "file_size": "2000",
+		      "distro": "noble",
+		      "branch": "vendor",
+		      "variant": "gnome",
+		      "promoted": "false",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    }
+		  ]
+		}`
+
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+		Expect(m.Images).To(HaveLen(2))
+		Expect(m.Images[0].Companions).To(Equal(map[string]string{".sha": "orangepi5/Bookworm_vendor_minimal.sha"}))
+
+		filter, err := newImageFilter(url.Values{"distro": {"Noble"}})
+
+		Expect(err).To(BeNil())
+		Expect(filter.match(m.Images[0])).To(BeFalse())
+		Expect(filter.match(m.Images[1])).To(BeTrue())
+
+		filter, err = newImageFilter(url.Values{"board": {"orangepi5"}, "promoted": {"true"}})
+
+		Expect(err).To(BeNil())
+		Expect(filter.match(m.Images[0])).To(BeTrue())
+		Expect(filter.match(m.Images[1])).To(BeFalse())
+
+		_, err = newImageFilter(url.Values{"promoted": {"maybe"}})
+
+		Expect(err).ToNot(BeNil())
 	})
 
 	It("Should successfully load the map from a JSON file, rewriting extension paths as necessary", func() {
@@ -96,12 +161,95 @@ var _ = Describe("Map", func() {
 		  ]
 		}`
 
-		m, err := loadMapJSON(strings.NewReader(data), testExtensions)
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths["khadas-vim1/Noble_current_xfce"]).To(Equal("/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+		Expect(m.Paths["khadas-vim1/Noble_current_xfce.sha"]).To(Equal("https://dl.armbian.com/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz.sha"))
+		Expect(m.Paths["khadas-vim1/Noble_current_xfce-test"]).To(Equal("/khadas-vim1/archive2/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+	})
+	It("Should generate latest and promoted aliases", func() {
+		data := `{
+		  "assets": [
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+		      "file_url_sha": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz.sha",
+		      "file_updated": "2024-05-28T10:00:00Z",
+		      "distro": "bookworm",
+		      "branch": "current",
+		      "variant": "minimal",
+		      "promoted": "true",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    },
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_noble_current_6.6.30_minimal.img.xz",
+		      "file_updated": "2024-05-29T10:00:00Z",
+		      "distro": "noble",
+		      "branch": "current",
+		      "variant": "minimal",
+		      "promoted": "false",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    },
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_jammy_current_6.6.30_minimal.img.xz",
+		      "file_updated": "2024-05-29T10:00:00Z",
+		      "distro": "jammy",
+		      "branch": "current",
+		      "variant": "minimal",
+		      "promoted": "false",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    }
+		  ]
+		}`
+
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{Latest: "latest", Promoted: "promoted"})
 
 		Expect(err).To(BeNil())
-		Expect(m["khadas-vim1/Noble_current_xfce"]).To(Equal("/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
-		Expect(m["khadas-vim1/Noble_current_xfce.sha"]).To(Equal("https://dl.armbian.com/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz.sha"))
-		Expect(m["khadas-vim1/Noble_current_xfce-test"]).To(Equal("/khadas-vim1/archive2/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+
+		// Jammy and Noble are both the newest, the lowest key wins
+		Expect(m.Paths["orangepi5/latest_current_minimal"]).To(Equal("/orangepi5/archive/Armbian_24.5.1_Orangepi5_jammy_current_6.6.30_minimal.img.xz"))
+		Expect(m.Paths["orangepi5/promoted"]).To(Equal("/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz"))
+		Expect(m.Paths["orangepi5/promoted.sha"]).To(Equal("https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz.sha"))
+		Expect(m.Files["orangepi5/promoted"]).To(Equal(m.Files["orangepi5/Bookworm_current_minimal"]))
+
+		Expect(m.Aliases).To(HaveLen(2))
+		Expect(m.Aliases[0].Key).To(Equal("orangepi5/latest_current_minimal"))
+		Expect(m.Aliases[0].Candidates).To(Equal([]string{
+			"orangepi5/Jammy_current_minimal",
+			"orangepi5/Noble_current_minimal",
+			"orangepi5/Bookworm_current_minimal",
+		}))
+	})
+	It("Should not replace existing keys with aliases", func() {
+		data := `{
+		  "assets": [
+		    {
+		      "board_slug": "orangepi5",
+		      "file_url": "https://dl.armbian.com/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz",
+		      "file_updated": "2024-05-28T10:00:00Z",
+		      "distro": "bookworm",
+		      "branch": "current",
+		      "variant": "minimal",
+		      "promoted": "false",
+		      "download_repository": "archive",
+		      "file_extension": "img.xz"
+		    }
+		  ]
+		}`
+
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{Latest: "Bookworm"})
+
+		Expect(err).To(BeNil())
+		Expect(m.Paths["orangepi5/Bookworm_current_minimal"]).To(Equal("/orangepi5/archive/Armbian_24.5.1_Orangepi5_bookworm_current_6.6.30_minimal.img.xz"))
+		Expect(m.Aliases).To(HaveLen(1))
+		Expect(m.Aliases[0].Conflict).To(BeTrue())
+		Expect(m.Aliases[0].Target).To(BeEmpty())
 	})
 	It("Should work with files that have weird extensions", func() {
 		data := `{
@@ -159,18 +307,18 @@ var _ = Describe("Map", func() {
   ]
 }`
 
-		m, err := loadMapJSON(strings.NewReader(data), testExtensions)
+		m, err := loadMapJSON(strings.NewReader(data), testExtensions, MapAliases{})
 
 		Expect(err).To(BeNil())
-		Expect(m["khadas-vim4/Bookworm_legacy_server"]).To(Equal("/khadas-vim4/archive/Armbian_23.11.1_Khadas-vim4_bookworm_legacy_5.4.180.oowow.img.xz"))
-		Expect(m["khadas-vim4/Bookworm_legacy_server.asc"]).To(Equal("asc_test_url_vim4"))
-		Expect(m["khadas-vim4/Bookworm_legacy_server.sha"]).To(Equal("sha_test_url_vim4"))
-
-		Expect(m["uefi-arm64/Bookworm_current_minimal-qcow2"]).To(Equal("/uefi-arm64/archive/Armbian_24.5.5_Uefi-arm64_bookworm_current_6.6.42_minimal.img.qcow2"))
-		Expect(m["uefi-arm64/Bookworm_current_minimal-qcow2.asc"]).To(Equal("asc_test_url_uefi"))
-		Expect(m["uefi-arm64/Bookworm_current_minimal-qcow2.sha"]).To(Equal("sha_test_url_uefi"))
-		Expect(m["nightly/qemu-uboot-arm64/Bookworm_current_minimal-uboot-bin"]).To(Equal("/armbian/os/releases/download/24.8.0-trunk.542/Armbian_24.8.0-trunk.542_Qemu-uboot-arm64_bookworm_current_6.6.44_minimal.u-boot.bin.xz"))
-		Expect(m["nightly/qemu-uboot-arm64/Bookworm_current_minimal-uboot-bin.boot.bin.xz"]).To(Equal("/armbian/os/releases/download/24.8.0-trunk.542/Armbian_24.8.0-trunk.542_Qemu-uboot-arm64_bookworm_current_6.6.44_minimal.u-boot.bin.xz"))
+		Expect(m.Paths["khadas-vim4/Bookworm_legacy_server"]).To(Equal("/khadas-vim4/archive/Armbian_23.11.1_Khadas-vim4_bookworm_legacy_5.4.180.oowow.img.xz"))
+		Expect(m.Paths["khadas-vim4/Bookworm_legacy_server.asc"]).To(Equal("asc_test_url_vim4"))
+		Expect(m.Paths["khadas-vim4/Bookworm_legacy_server.sha"]).To(Equal("sha_test_url_vim4"))
+
+		Expect(m.Paths["uefi-arm64/Bookworm_current_minimal-qcow2"]).To(Equal("/uefi-arm64/archive/Armbian_24.5.5_Uefi-arm64_bookworm_current_6.6.42_minimal.img.qcow2"))
+		Expect(m.Paths["uefi-arm64/Bookworm_current_minimal-qcow2.asc"]).To(Equal("asc_test_url_uefi"))
+		Expect(m.Paths["uefi-arm64/Bookworm_current_minimal-qcow2.sha"]).To(Equal("sha_test_url_uefi"))
+		Expect(m.Paths["nightly/qemu-uboot-arm64/Bookworm_current_minimal-uboot-bin"]).To(Equal("/armbian/os/releases/download/24.8.0-trunk.542/Armbian_24.8.0-trunk.542_Qemu-uboot-arm64_bookworm_current_6.6.44_minimal.u-boot.bin.xz"))
+		Expect(m.Paths["nightly/qemu-uboot-arm64/Bookworm_current_minimal-uboot-bin.boot.bin.xz"]).To(Equal("/armbian/os/releases/download/24.8.0-trunk.542/Armbian_24.8.0-trunk.542_Qemu-uboot-arm64_bookworm_current_6.6.44_minimal.u-boot.bin.xz"))
 
 	})
 })
@@ -0,0 +1,234 @@
+package redirector
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMapPollInterval is the default interval at which a remote download map is polled.
+const defaultMapPollInterval = 5 * time.Minute
+
+// maxRemoteMapSize is the maximum size of a remote download map.
+const maxRemoteMapSize = 64 << 20
+
+// errMapNotModified is returned when a remote download map did not change since it was last fetched.
+var errMapNotModified = errors.New("download map not modified")
+
+// mapRefreshed is the time (in unix nanoseconds) the download map was last confirmed current with its source.
+var mapRefreshed atomic.Int64
+
+var mapAge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "armbian_router_map_age_seconds",
+	Help: "The time since the download map was last loaded or confirmed current with its source",
+}, func() float64 {
+	refreshed := mapRefreshed.Load()
+
+	if refreshed == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, refreshed)).Seconds()
+})
+
+// remoteMapState is the validator of the last fetched remote download map, for conditional requests.
+// It only applies while the map fetched from source is the current one.
+type remoteMapState struct {
+	source       string
+	dm           *DownloadMap
+	etag         string
+	lastModified string
+}
+
+// isRemoteMap returns true if the download map is an http(s) url.
+func isRemoteMap(mapFile string) bool {
+	return strings.HasPrefix(mapFile, "https://") || strings.HasPrefix(mapFile, "http://")
+}
+
+// fetchMap fetches a remote download map with a conditional request through the check client transport,
+// returning errMapNotModified if it did not change. Valid maps are kept in the cache file.
+// If the map can't be fetched on start, the cache file is loaded instead.
+// The caller must hold the map lock.
+func (r *Redirector) fetchMap(mapURL string) (*DownloadMap, time.Time, error) {
+	dm, err := r.fetchRemoteMap(mapURL)
+
+	if err == nil || errors.Is(err, errMapNotModified) || r.dlMap.Load() != nil || r.config.MapCacheFile == "" {
+		return dm, time.Now(), err
+	}
+
+	log.WithError(err).WithField("file", r.config.MapCacheFile).Warning("Unable to fetch download map, loading the cached copy")
+
+	info, statErr := os.Stat(r.config.MapCacheFile)
+
+	if statErr != nil {
+		return nil, time.Time{}, err
+	}
+
+	dm, cacheErr := loadMapCache(r.config.MapCacheFile, mapURL, r.config)
+
+	if cacheErr != nil {
+		log.WithError(cacheErr).WithField("file", r.config.MapCacheFile).Warning("Unable to load the cached download map")
+		return nil, time.Time{}, err
+	}
+
+	return dm, info.ModTime(), nil
+}
+
+// loadMapCache loads the cache file of a remote map, in the format of the url path extension.
+func loadMapCache(file, mapURL string, config *Config) (*DownloadMap, error) {
+	u, err := url.Parse(mapURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return loadMap(f, path.Ext(u.Path), config)
+}
+
+// fetchRemoteMap fetches and parses a remote download map, in the format of the url path extension.
+func (r *Redirector) fetchRemoteMap(mapURL string) (*DownloadMap, error) {
+	u, err := url.Parse(mapURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, mapURL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "ArmbianRouter/1.0 (Go "+runtime.Version()+")")
+
+	// Only ask for changes if the current map was fetched from this url
+	if dm := r.dlMap.Load(); dm != nil && dm == r.remoteMap.dm && r.remoteMap.source == mapURL {
+		if r.remoteMap.etag != "" {
+			req.Header.Set("If-None-Match", r.remoteMap.etag)
+		}
+
+		if r.remoteMap.lastModified != "" {
+			req.Header.Set("If-Modified-Since", r.remoteMap.lastModified)
+		}
+	}
+
+	log.WithField("url", mapURL).Debug("Fetching download map")
+
+	res, err := fetchClient(r.config).Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, errMapNotModified
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %d", res.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxRemoteMapSize))
+
+	if err != nil {
+		return nil, err
+	}
+
+	dm, err := loadMap(bytes.NewReader(b), path.Ext(u.Path), r.config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dm.validate(); err != nil {
+		return nil, err
+	}
+
+	log.WithField("url", mapURL).Info("Loaded remote download map")
+
+	r.remoteMap = remoteMapState{
+		source:       mapURL,
+		dm:           dm,
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+
+	if r.config.MapCacheFile != "" {
+		if err := writeMapCache(r.config.MapCacheFile, b); err != nil {
+			log.WithError(err).WithField("file", r.config.MapCacheFile).Warning("Unable to write download map cache")
+		}
+	}
+
+	return dm, nil
+}
+
+// writeMapCache replaces the cache file through a rename, so it is never left half written.
+func writeMapCache(file string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// pollMap reloads a remote download map at an interval.
+func (r *Redirector) pollMap(interval time.Duration) *mapFollower {
+	f := newMapFollower()
+
+	go func() {
+		defer close(f.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+				if err := r.reloadMap(); err != nil {
+					log.WithError(err).Warning("Unable to reload remote download map, keeping the previous one")
+				}
+			}
+		}
+	}()
+
+	return f
+}
@@ -0,0 +1,159 @@
+package redirector
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remote map", func() {
+	var (
+		server    *httptest.Server
+		available atomic.Bool
+		requests  atomic.Int32
+		cacheFile string
+	)
+
+	BeforeEach(func() {
+		available.Store(true)
+		requests.Store(0)
+
+		cacheFile = filepath.Join(GinkgoT().TempDir(), "map.cache")
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests.Add(1)
+
+			// Published maps are often served behind a redirect
+			if req.URL.Path == "/latest/map.csv" {
+				http.Redirect(w, req, "/map.csv", http.StatusFound)
+				return
+			}
+
+			if !available.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+
+			if req.URL.Path == "/other.csv" {
+				w.Write([]byte("c,/target/c.img.xz\n"))
+				return
+			}
+
+			w.Write([]byte("a,/target/a.img.xz\n"))
+		}))
+
+		DeferCleanup(server.Close)
+	})
+
+	It("Should fetch the map and ask for changes afterwards", func() {
+		r := New(&Config{MapFile: server.URL + "/map.csv", MapCacheFile: cacheFile})
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKeyWithValue("a", "/target/a.img.xz"))
+
+		current := r.dlMap.Load()
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(requests.Load()).To(Equal(int32(2)))
+		Expect(r.dlMap.Load()).To(BeIdenticalTo(current))
+
+		b, err := os.ReadFile(cacheFile)
+
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("a,/target/a.img.xz\n"))
+	})
+
+	It("Should keep the previous map when the remote fails", func() {
+		r := New(&Config{MapFile: server.URL + "/map.csv"})
+
+		Expect(r.reloadMap()).To(Succeed())
+
+		available.Store(false)
+
+		Expect(r.reloadMap()).ToNot(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+	})
+
+	It("Should load the cached copy on a cold start", func() {
+		Expect(os.WriteFile(cacheFile, []byte("b,/target/b.img.xz\n"), 0o644)).To(Succeed())
+
+		available.Store(false)
+
+		r := New(&Config{MapFile: server.URL + "/map.csv", MapCacheFile: cacheFile})
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("b"))
+
+		// The cached copy has no validators, so the map is fetched in full
+		available.Store(true)
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+	})
+
+	It("Should follow redirects through the check client transport", func() {
+		config := &Config{MapFile: server.URL + "/latest/map.csv"}
+		config.SetRootCAs(x509.NewCertPool())
+
+		r := New(config)
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+	})
+
+	It("Should keep the previous map when a config reload can't fetch it", func() {
+		r := New(&Config{MapFile: server.URL + "/map.csv"})
+
+		available.Store(false)
+
+		Expect(r.reloadConfiguredMap()).ToNot(Succeed())
+
+		available.Store(true)
+
+		Expect(r.reloadConfiguredMap()).To(Succeed())
+		defer r.mapFollower.close()
+
+		available.Store(false)
+
+		Expect(r.reloadConfiguredMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+	})
+
+	It("Should only ask for changes of the map fetched from the same url", func() {
+		localFile := filepath.Join(GinkgoT().TempDir(), "local.csv")
+		Expect(os.WriteFile(localFile, []byte("b,/target/b.img.xz\n"), 0o644)).To(Succeed())
+
+		config := &Config{MapFile: server.URL + "/map.csv"}
+		r := New(config)
+
+		Expect(r.reloadMap()).To(Succeed())
+
+		config.MapFile = localFile
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("b"))
+
+		config.MapFile = server.URL + "/map.csv"
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+
+		config.MapFile = server.URL + "/other.csv"
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.dlMap.Load().Paths).To(HaveKey("c"))
+	})
+})
@@ -0,0 +1,146 @@
+package redirector
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// mapWatchDelay is the time to wait for writes to the map file to settle before reloading it.
+const mapWatchDelay = 2 * time.Second
+
+// mapFollower is a running watcher or poller of the download map.
+type mapFollower struct {
+	source   string
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newMapFollower() *mapFollower {
+	return &mapFollower{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// close stops the watcher or poller, and waits for it to exit.
+func (f *mapFollower) close() {
+	close(f.stop)
+	<-f.done
+}
+
+// followMap watches the file or polls the url of the download map, replacing the previous
+// watcher or poller if the map source changed. It is called on every config reload.
+func (r *Redirector) followMap() error {
+	source := r.config.MapFile
+	interval := r.config.MapPollInterval
+
+	if interval <= 0 {
+		interval = defaultMapPollInterval
+	}
+
+	if f := r.mapFollower; f != nil {
+		if f.source == source && f.interval == interval {
+			return nil
+		}
+
+		f.close()
+		r.mapFollower = nil
+	}
+
+	if source == "" {
+		return nil
+	}
+
+	var f *mapFollower
+
+	if isRemoteMap(source) {
+		f = r.pollMap(interval)
+	} else {
+		var err error
+
+		if f, err = r.watchMap(mapWatchDelay); err != nil {
+			return err
+		}
+	}
+
+	f.source = source
+	f.interval = interval
+	r.mapFollower = f
+
+	return nil
+}
+
+// watchMap reloads the download map on its own when its file changes, once no change happened for delay.
+// The directory is watched, so files replaced by a rename are picked up as well.
+func (r *Redirector) watchMap(delay time.Duration) (*mapFollower, error) {
+	file, err := filepath.Abs(r.config.MapFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	log.WithField("file", file).Info("Watching download map for changes")
+
+	reload := func() {
+		if err := r.reloadMap(); err != nil {
+			log.WithError(err).Warning("Unable to reload download map, keeping the previous one")
+		}
+	}
+
+	f := newMapFollower()
+
+	go func() {
+		defer close(f.done)
+		defer watcher.Close()
+
+		var timer *time.Timer
+
+		for {
+			select {
+			case <-f.stop:
+				if timer != nil {
+					timer.Stop()
+				}
+
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) != file || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+
+				if timer == nil {
+					timer = time.AfterFunc(delay, reload)
+				} else {
+					timer.Reset(delay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.WithError(err).Warning("Download map watcher error")
+			}
+		}
+	}()
+
+	return f, nil
+}
@@ -0,0 +1,106 @@
+package redirector
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Map watcher", func() {
+	asset := func(board string) string {
+		return `{"assets": [{
+			"board_slug": "` + board + `",
+			"file_url": "https://dl.armbian.com/` + board + `/archive/Armbian_24.5.1_bookworm_current_6.6.30_minimal.img.xz",
+			"distro": "bookworm",
+			"branch": "current",
+			"variant": "minimal",
+			"download_repository": "archive",
+			"file_extension": "img.xz"
+		}]}`
+	}
+
+	It("Should reload the map when its file changes, keeping the previous map on errors", func() {
+		file := filepath.Join(GinkgoT().TempDir(), "map.json")
+
+		Expect(os.WriteFile(file, []byte(asset("orangepi5")), 0o644)).To(Succeed())
+
+		r := New(&Config{MapFile: file})
+
+		Expect(r.reloadMap()).To(Succeed())
+
+		f, err := r.watchMap(50 * time.Millisecond)
+
+		Expect(err).To(BeNil())
+		defer f.close()
+
+		Expect(os.WriteFile(file, []byte(asset("rock-5b")), 0o644)).To(Succeed())
+
+		Eventually(func() map[string]string {
+			return r.dlMap.Load().Paths
+		}).Should(HaveKey("rock-5b/Bookworm_current_minimal"))
+
+		// A truncated file is not swapped in
+		Expect(os.WriteFile(file, []byte(`{"assets": [`), 0o644)).To(Succeed())
+
+		Consistently(func() map[string]string {
+			return r.dlMap.Load().Paths
+		}, 300*time.Millisecond).Should(HaveKey("rock-5b/Bookworm_current_minimal"))
+	})
+
+	It("Should follow the map to another file on reload", func() {
+		dir := GinkgoT().TempDir()
+		first := filepath.Join(dir, "first", "map.json")
+		second := filepath.Join(dir, "second", "map.json")
+
+		for _, file := range []string{first, second} {
+			Expect(os.MkdirAll(filepath.Dir(file), 0o755)).To(Succeed())
+			Expect(os.WriteFile(file, []byte(asset("orangepi5")), 0o644)).To(Succeed())
+		}
+
+		r := New(&Config{MapFile: first})
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.followMap()).To(Succeed())
+
+		previous := r.mapFollower
+
+		r.config.MapFile = second
+
+		Expect(r.reloadMap()).To(Succeed())
+		Expect(r.followMap()).To(Succeed())
+		defer r.mapFollower.close()
+
+		Expect(r.mapFollower).ToNot(BeIdenticalTo(previous))
+		Eventually(previous.done).Should(BeClosed())
+
+		// The same source keeps the running watcher
+		current := r.mapFollower
+
+		Expect(r.followMap()).To(Succeed())
+		Expect(r.mapFollower).To(BeIdenticalTo(current))
+
+		Expect(os.WriteFile(second, []byte(asset("rock-5b")), 0o644)).To(Succeed())
+
+		Eventually(func() map[string]string {
+			return r.dlMap.Load().Paths
+		}, 5*time.Second).Should(HaveKey("rock-5b/Bookworm_current_minimal"))
+	})
+
+	It("Should not swap in empty maps", func() {
+		file := filepath.Join(GinkgoT().TempDir(), "map.csv")
+
+		Expect(os.WriteFile(file, []byte("a,/a.img.xz\n"), 0o644)).To(Succeed())
+
+		r := New(&Config{MapFile: file})
+
+		Expect(r.reloadMap()).To(Succeed())
+
+		Expect(os.WriteFile(file, nil, 0o644)).To(Succeed())
+
+		Expect(r.reloadMap()).To(Equal(ErrEmptyMap))
+		Expect(r.dlMap.Load().Paths).To(HaveKey("a"))
+	})
+})
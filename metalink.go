@@ -0,0 +1,125 @@
+package redirector
+
+import (
+	"encoding/xml"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metalinkExtension is the extension appended to mapped image paths to request a metalink.
+const metalinkExtension = ".meta4"
+
+// defaultMetalinkSize is the number of mirrors listed in a metalink.
+const defaultMetalinkSize = 5
+
+// Metalink is a Metalink 4 document, as defined in RFC 5854.
+type Metalink struct {
+	XMLName   xml.Name       `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Generator string         `xml:"generator"`
+	Published string         `xml:"published,omitempty"`
+	Files     []MetalinkFile `xml:"file"`
+}
+
+// MetalinkFile is a file in a metalink, with the urls it can be downloaded from.
+type MetalinkFile struct {
+	Name string        `xml:"name,attr"`
+	Size int64         `xml:"size,omitempty"`
+	Hash *MetalinkHash `xml:"hash,omitempty"`
+	URLs []MetalinkURL `xml:"url"`
+}
+
+// MetalinkHash is a file checksum in a metalink.
+type MetalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MetalinkURL is a download url in a metalink. Lower priorities are preferred.
+type MetalinkURL struct {
+	Location string `xml:"location,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+// metalinkHandler returns a metalink for a mapped image, listing the client's top mirrors
+// in order of preference, along with the file size and SHA-256 checksum.
+func (r *Redirector) metalinkHandler(w http.ResponseWriter, req *http.Request, ip net.IP, key string, file *ReleaseFile) {
+	scheme := requestScheme(req)
+	ipv6 := isIPv6(ip)
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n := queryInt(req, "n", defaultMetalinkSize, len(r.servers))
+
+	var urls []MetalinkURL
+
+	for _, item := range r.rankedURLs(ranked, scheme, key, ipv6, n) {
+		location := ""
+
+		if !item.Target.External {
+			location = strings.ToLower(item.Server.Country)
+		}
+
+		urls = append(urls, MetalinkURL{
+			Location: location,
+			Priority: len(urls) + 1,
+			URL:      item.Target.URL,
+		})
+	}
+
+	if len(urls) == 0 {
+		http.Error(w, "No servers available", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := path.Base(file.FileURL)
+
+	doc := Metalink{
+		Generator: "ArmbianRouter/1.0",
+		Files: []MetalinkFile{
+			{
+				Name: name,
+				Size: file.Size(),
+				URLs: urls,
+			},
+		},
+	}
+
+	if updated, err := time.Parse(time.RFC3339, file.FileUpdated); err == nil {
+		doc.Published = updated.UTC().Format(time.RFC3339)
+	}
+
+	if file.FileURLSHA != "" {
+		if sum, err := r.checksums.get(file.FileURLSHA); err == nil {
+			doc.Files[0].Hash = &MetalinkHash{
+				Type:  "sha-256",
+				Value: sum,
+			}
+		} else {
+			log.WithError(err).WithField("url", file.FileURLSHA).Warning("Unable to load checksum")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/metalink4+xml")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+metalinkExtension+"\"")
+
+	w.Write([]byte(xml.Header))
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(doc); err != nil {
+		log.WithError(err).Warning("Unable to encode metalink")
+	}
+}
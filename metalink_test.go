@@ -0,0 +1,140 @@
+package redirector
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const testChecksum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+var _ = Describe("Metalinks", func() {
+	It("Should parse sha256sum files", func() {
+		sum, err := parseChecksum(strings.NewReader(strings.ToUpper(testChecksum) + "  Armbian.img.xz\n"))
+
+		Expect(err).To(BeNil())
+		Expect(sum).To(Equal(testChecksum))
+
+		_, err = parseChecksum(strings.NewReader("not a checksum  Armbian.img.xz\n"))
+		Expect(err).To(Equal(ErrInvalidChecksum))
+
+		_, err = parseChecksum(strings.NewReader(""))
+		Expect(err).To(Equal(ErrInvalidChecksum))
+	})
+
+	It("Should fetch and cache checksums, following redirects", func() {
+		var requests int
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+
+			if r.URL.Path == "/Armbian.img.xz.sha" {
+				http.Redirect(w, r, "/mirror/Armbian.img.xz.sha", http.StatusFound)
+				return
+			}
+
+			w.Write([]byte(testChecksum + "  Armbian.img.xz\n"))
+		}))
+		defer server.Close()
+
+		config := &Config{}
+		config.SetRootCAs(x509.NewCertPool())
+
+		store := newChecksumStore(config)
+
+		for i := 0; i < 2; i++ {
+			sum, err := store.get(server.URL + "/Armbian.img.xz.sha")
+
+			Expect(err).To(BeNil())
+			Expect(sum).To(Equal(testChecksum))
+		}
+
+		Expect(requests).To(Equal(2))
+
+		store.reset()
+
+		_, err := store.get(server.URL + "/Armbian.img.xz.sha")
+		Expect(err).To(BeNil())
+		Expect(requests).To(Equal(4))
+	})
+
+	It("Should cache failures and share concurrent downloads", func() {
+		var requests atomic.Int32
+		release := make(chan struct{})
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+
+			if r.URL.Path == "/missing.sha" {
+				http.NotFound(w, r)
+				return
+			}
+
+			<-release
+			w.Write([]byte(testChecksum + "  Armbian.img.xz\n"))
+		}))
+		defer server.Close()
+
+		// Without SetRootCAs, the default transport is used
+		store := newChecksumStore(&Config{})
+
+		for i := 0; i < 2; i++ {
+			_, err := store.get(server.URL + "/missing.sha")
+			Expect(err).ToNot(BeNil())
+		}
+
+		Expect(requests.Load()).To(Equal(int32(1)))
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				sum, err := store.get(server.URL + "/Armbian.img.xz.sha")
+
+				Expect(err).To(BeNil())
+				Expect(sum).To(Equal(testChecksum))
+			}()
+		}
+
+		Eventually(requests.Load).Should(Equal(int32(2)))
+		close(release)
+		wg.Wait()
+
+		Expect(requests.Load()).To(Equal(int32(2)))
+	})
+
+	It("Should encode RFC 5854 documents", func() {
+		doc := Metalink{
+			Generator: "ArmbianRouter/1.0",
+			Files: []MetalinkFile{
+				{
+					Name: "Armbian.img.xz",
+					Size: 1024,
+					Hash: &MetalinkHash{Type: "sha-256", Value: testChecksum},
+					URLs: []MetalinkURL{
+						{Location: "de", Priority: 1, URL: "https://mirror.example.com/Armbian.img.xz"},
+					},
+				},
+			},
+		}
+
+		b, err := xml.Marshal(doc)
+
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><generator>ArmbianRouter/1.0</generator>` +
+			`<file name="Armbian.img.xz"><size>1024</size><hash type="sha-256">` + testChecksum + `</hash>` +
+			`<url location="de" priority="1">https://mirror.example.com/Armbian.img.xz</url></file></metalink>`))
+	})
+})
@@ -1,10 +1,8 @@
 package redirector
 
 import (
-	// embed is a blank import for Go's embedding, used for image files.
-	_ "embed"
 	"encoding/json"
-	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
 	"strings"
@@ -31,65 +29,81 @@ func (r *Redirector) legacyMirrorsHandler(w http.ResponseWriter, req *http.Reque
 }
 
 // mirrorsHandler is a simple handler that will return the list of servers
+// Each server is encoded under its lock, as checks update them concurrently.
 func (r *Redirector) mirrorsHandler(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(r.servers)
-}
+	list := make([]json.RawMessage, 0, len(r.servers))
 
-var (
-	//go:embed assets/status-up.svg
-	statusUp []byte
+	for _, server := range r.servers {
+		server.mu.RLock()
+		b, err := json.Marshal(server)
+		server.mu.RUnlock()
 
-	//go:embed assets/status-down.svg
-	statusDown []byte
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	//go:embed assets/status-unknown.svg
-	statusUnknown []byte
-)
+		list = append(list, b)
+	}
 
-// mirrorStatusHandler is a fancy svg-returning handler.
-// it is used to display mirror statuses on a config repo of sorts
-func (r *Redirector) mirrorStatusHandler(w http.ResponseWriter, req *http.Request) {
-	serverHost := chi.URLParam(req, "server")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
 
-	w.Header().Set("Content-Type", "image/svg+xml;charset=utf-8")
-	w.Header().Set("Cache-Control", "max-age=120")
+// defaultMirrorlistSize is the number of mirrors returned in an apt mirrorlist.
+const defaultMirrorlistSize = 5
 
-	if serverHost == "" {
-		w.Write(statusUnknown)
+// aptMirrorlistHandler returns the client's ranked mirrors in the apt mirror method format,
+// for use with mirror+http:// sources. Lower priorities are preferred by apt.
+// The number of mirrors can be set with ?n=, and the scheme with ?scheme=.
+func (r *Redirector) aptMirrorlistHandler(w http.ResponseWriter, req *http.Request) {
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	serverHost = strings.Replace(serverHost, "_", ".", -1)
+	scheme := req.URL.Query().Get("scheme")
+
+	if scheme != "http" && scheme != "https" {
+		scheme = requestScheme(req)
+	}
+
+	ipv6 := isIPv6(ip)
 
-	server, ok := r.hostMap[serverHost]
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
 
-	if !ok {
-		w.Header().Set("Content-Length", strconv.Itoa(len(statusUnknown)))
-		w.Write(statusUnknown)
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	key := "offline"
+	n := queryInt(req, "n", defaultMirrorlistSize, len(r.servers))
 
-	if server.Available {
-		key = "online"
+	if len(ranked) > n {
+		ranked = ranked[:n]
 	}
 
-	w.Header().Set("ETag", "\""+key+"\"")
+	var sb strings.Builder
 
-	if match := req.Header.Get("If-None-Match"); match != "" {
-		if strings.Trim(match, "\"") == key {
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
+	for i, item := range ranked {
+		sb.WriteString(r.resolve(item.Server, scheme, "/", ipv6).URL)
+		sb.WriteString("\tpriority:")
+		sb.WriteString(strconv.Itoa(i + 1))
+		sb.WriteString("\n")
 	}
 
-	if server.Available {
-		w.Header().Set("Content-Length", strconv.Itoa(len(statusUp)))
-		w.Write(statusUp)
-	} else {
-		w.Header().Set("Content-Length", strconv.Itoa(len(statusDown)))
-		w.Write(statusDown)
+	// The fallback is only used by apt when none of the mirrors work
+	if r.config.MirrorlistFallback != "" {
+		sb.WriteString(r.config.MirrorlistFallback)
+		sb.WriteString("\tpriority:")
+		sb.WriteString(strconv.Itoa(len(ranked) + 1))
+		sb.WriteString("\n")
 	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write([]byte(sb.String()))
 }
@@ -0,0 +1,52 @@
+package redirector
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mirrorlist", func() {
+	var r *Redirector
+
+	BeforeEach(func() {
+		r = newGeoRedirector()
+	})
+
+	get := func(url string) string {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = berlinClient + ":1234"
+
+		w := httptest.NewRecorder()
+		r.aptMirrorlistHandler(w, req)
+
+		Expect(w.Header().Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+
+		return w.Body.String()
+	}
+
+	It("Should list mirrors by priority, closest first", func() {
+		Expect(get("/mirrorlist/apt.txt?scheme=https")).To(Equal(
+			"https://berlin.example.com/apt/\tpriority:1\n" +
+				"https://munich.example.com/apt/\tpriority:2\n" +
+				"https://paris.example.com/apt/\tpriority:3\n",
+		))
+	})
+
+	It("Should limit the number of mirrors and append the fallback", func() {
+		r.config.MirrorlistFallback = "https://apt.armbian.com"
+
+		Expect(get("/mirrorlist/apt.txt?scheme=http&n=1")).To(Equal(
+			"http://berlin.example.com/apt/\tpriority:1\n" +
+				"https://apt.armbian.com\tpriority:2\n",
+		))
+	})
+
+	It("Should not list unhealthy mirrors", func() {
+		r.servers[0].Available = false
+		r.servers[2].Available = false
+
+		Expect(get("/mirrorlist/apt.txt?scheme=https")).To(Equal("https://munich.example.com/apt/\tpriority:1\n"))
+	})
+})
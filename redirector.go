@@ -1,14 +1,16 @@
 package redirector
 
 import (
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/armbian/redirector/middleware"
 	logger "github.com/chi-middleware/logrus-logger"
 	"github.com/go-chi/chi/v5"
 	cm "github.com/go-chi/chi/v5/middleware"
 	lru "github.com/hashicorp/golang-lru"
-	"github.com/oschwald/maxminddb-golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,21 +27,60 @@ var (
 		Name: "armbian_router_download_maps",
 		Help: "The total number of mapped download paths",
 	})
+
+	retriesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_retries",
+		Help: "The total number of redirects excluding hosts that failed for the client",
+	})
+
+	mapReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_map_reloads",
+		Help: "The total number of successful download map reloads",
+	})
+
+	mapReloadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_map_reload_failures",
+		Help: "The total number of failed download map reloads, which kept the previous map",
+	})
+
+	mapEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "armbian_router_map_entries",
+		Help: "The number of paths in the download map",
+	})
+
+	mapImages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "armbian_router_map_images",
+		Help: "The number of images in the download map",
+	})
 )
 
+// geoReader looks up records in a MaxMind database, like *maxminddb.Reader.
+type geoReader interface {
+	Lookup(ip net.IP, result any) error
+	Close() error
+}
+
 // Redirector is our application instance.
 type Redirector struct {
 	config      *Config
-	db          *maxminddb.Reader
-	asnDB       *maxminddb.Reader
+	db          geoReader
+	asnDB       geoReader
 	servers     ServerList
 	regionMap   map[string][]*Server
 	hostMap     map[string]*Server
-	dlMap       map[string]string
+	dlMap       atomic.Pointer[DownloadMap]
+	mapLock     sync.Mutex
+	remoteMap   remoteMapState
+	mapFollower *mapFollower
 	topChoices  int
 	serverCache *lru.Cache
 	checks      []ServerCheck
 	checkClient *http.Client
+	feedback    *feedbackStore
+	exclusions  *lru.Cache
+	checksums   *checksumStore
+	torrents    *torrentStore
+	events      *eventBroker
 }
 
 // ServerConfig is a configuration struct holding basic server configuration.
@@ -52,6 +93,27 @@ type ServerConfig struct {
 	Weight    int      `mapstructure:"weight" yaml:"weight"`
 	Protocols []string `mapstructure:"protocols" yaml:"protocols"`
 	Rules     []Rule   `mapstructure:"rules" yaml:"rules"`
+
+	// Rewrites change the final path for mirrors with a different directory layout.
+	Rewrites []Rewrite `mapstructure:"rewrites" yaml:"rewrites"`
+
+	// IPv4Host and IPv6Host are optional address family specific host names, like ipv6.mirror.example.
+	// Clients are redirected to the host matching their address family, and each host is checked separately.
+	IPv4Host string `mapstructure:"ipv4_host" yaml:"ipv4_host"`
+	IPv6Host string `mapstructure:"ipv6_host" yaml:"ipv6_host"`
+
+	// RsyncModule is the rsync module (and optional path) of servers offering rsync, like "armbian/apt".
+	// It defaults to the first part of the server path when rsync is in Protocols.
+	RsyncModule string `mapstructure:"rsync_module" yaml:"rsync_module"`
+
+	// Global marks anycast or CDN backends, which are not geolocated.
+	// They are treated as equidistant to every client, at Distance meters (or the globalDistance default).
+	Global   bool    `mapstructure:"global" yaml:"global"`
+	Distance float64 `mapstructure:"distance" yaml:"distance"`
+
+	// MonthlyBudget is an optional monthly transfer quota, like "50TB".
+	// The server's weight is reduced as it nears the quota, and it is removed at the limit.
+	MonthlyBudget string `mapstructure:"monthly_budget" yaml:"monthly_budget"`
 }
 
 // Rule defines a matching rule on a server.
@@ -66,8 +128,15 @@ type Rule struct {
 
 // New creates a new instance of Redirector
 func New(config *Config) *Redirector {
+	exclusions, _ := lru.New(exclusionReports)
+
 	r := &Redirector{
-		config: config,
+		config:     config,
+		feedback:   newFeedbackStore(),
+		exclusions: exclusions,
+		checksums:  newChecksumStore(config),
+		torrents:   newTorrentStore(config),
+		events:     newEventBroker(),
 	}
 
 	r.checks = []ServerCheck{
@@ -80,6 +149,9 @@ func New(config *Config) *Redirector {
 		&IPv6Check{
 			config: config,
 		},
+		&RsyncCheck{
+			config: config,
+		},
 	}
 
 	if config.CheckURL != "" {
@@ -114,13 +186,26 @@ func (r *Redirector) Start() http.Handler {
 	router.Head("/status", r.statusHandler)
 	router.Get("/status", r.statusHandler)
 	router.Get("/mirrors", r.legacyMirrorsHandler)
+	router.Get("/status/mirrors", r.mirrorStatusPageHandler)
 	router.Get("/mirrors/{server}.svg", r.mirrorStatusHandler)
 	router.Get("/mirrors.json", r.mirrorsHandler)
+	router.Get("/mirrorlist/apt.txt", r.aptMirrorlistHandler)
+	router.Get("/rsync/closest", r.rsyncClosestHandler)
 	router.Post("/reload", r.reloadHandler)
+	router.Get("/events", r.eventsHandler)
 	router.Get("/dl_map", r.dlMapHandler)
+	router.Get("/feeds/images.atom", r.imagesFeedHandler)
+	router.Post("/feedback", r.feedbackHandler)
 	router.Get("/geoip", r.geoIPHandler)
 	router.Get("/metrics", promhttp.Handler().ServeHTTP)
 
+	router.Route("/api/v1", func(api chi.Router) {
+		api.Get("/select", r.selectHandler)
+		api.Get("/images", r.imagesHandler)
+		api.Get("/mirrors", r.mirrorsAPIHandler)
+		api.Get("/speedtest", r.speedTestHandler)
+	})
+
 	if r.config.EnableProfiler {
 		log.Warn("Enabling pprof profiler endpoints")
 		router.Mount("/debug", cm.Profiler())
@@ -0,0 +1,78 @@
+package redirector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rewrite defines a path rewrite on a server, for mirrors with a different directory layout.
+// It is matched against the full path on the mirror (including the server path).
+// Prefix replaces a leading path, Match is a regular expression, and Replace is the replacement
+// for either (regular expressions can use $1 style references).
+type Rewrite struct {
+	Prefix  string `mapstructure:"prefix" yaml:"prefix" json:"prefix,omitempty"`
+	Match   string `mapstructure:"match" yaml:"match" json:"match,omitempty"`
+	Replace string `mapstructure:"replace" yaml:"replace" json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// compileRewrites validates rewrites and compiles their regular expressions.
+func compileRewrites(rewrites []Rewrite) ([]Rewrite, error) {
+	compiled := make([]Rewrite, len(rewrites))
+
+	for i, rewrite := range rewrites {
+		if (rewrite.Prefix == "") == (rewrite.Match == "") {
+			return nil, fmt.Errorf("rewrite %d must have either a prefix or a match", i)
+		}
+
+		if rewrite.Match != "" {
+			re, err := regexp.Compile(rewrite.Match)
+
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %d: %w", i, err)
+			}
+
+			rewrite.re = re
+		}
+
+		compiled[i] = rewrite
+	}
+
+	return compiled, nil
+}
+
+// rewrite applies the first matching rewrite of the server to a path.
+// Prefixes match whole path segments, with or without their trailing slash.
+func (s *Server) rewrite(p string) string {
+	for _, rewrite := range s.Rewrites {
+		if rewrite.re != nil {
+			if rewrite.re.MatchString(p) {
+				return rewrite.re.ReplaceAllString(p, rewrite.Replace)
+			}
+
+			continue
+		}
+
+		prefix := strings.TrimSuffix(rewrite.Prefix, "/")
+
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return strings.TrimSuffix(rewrite.Replace, "/") + strings.TrimPrefix(p, prefix)
+		}
+	}
+
+	return p
+}
+
+// MirrorURLs returns the url each server would redirect a request path to, keyed by host.
+// This shows the effect of the download map and rewrites, e.g. in tests.
+func (r *Redirector) MirrorURLs(scheme, requestPath string, ipv6 bool) map[string]string {
+	urls := make(map[string]string, len(r.servers))
+
+	for _, server := range r.servers {
+		urls[server.Host] = r.resolve(server, scheme, requestPath, ipv6).URL
+	}
+
+	return urls
+}
@@ -0,0 +1,89 @@
+package redirector
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rewrites", func() {
+	var r *Redirector
+
+	newServer := func(host, path string, rewrites ...Rewrite) *Server {
+		compiled, err := compileRewrites(rewrites)
+
+		Expect(err).To(BeNil())
+
+		return &Server{
+			Host:     host,
+			Path:     path,
+			Rewrites: compiled,
+		}
+	}
+
+	BeforeEach(func() {
+		r = New(&Config{})
+		r.servers = ServerList{
+			newServer("plain.example.com", "/armbian/"),
+			newServer("split.example.com", "/armbian/apt/",
+				Rewrite{Prefix: "/armbian/apt/dl/", Replace: "/armbian-dl/"},
+			),
+			newServer("flat.example.com", "/armbian/",
+				Rewrite{Match: `^/armbian/dl/[^/]+/archive/(.+)$`, Replace: "/armbian/images/$1"},
+			),
+		}
+		r.dlMap.Store(&DownloadMap{
+			Paths: map[string]string{
+				"khadas-vim1/Noble_current_xfce": "/dl/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz",
+			},
+		})
+	})
+
+	It("Should leave servers without rewrites unchanged", func() {
+		urls := r.MirrorURLs("https", "/dists/bookworm/InRelease", false)
+
+		Expect(urls["plain.example.com"]).To(Equal("https://plain.example.com/armbian/dists/bookworm/InRelease"))
+		Expect(urls["split.example.com"]).To(Equal("https://split.example.com/armbian/apt/dists/bookworm/InRelease"))
+		Expect(urls["flat.example.com"]).To(Equal("https://flat.example.com/armbian/dists/bookworm/InRelease"))
+	})
+
+	It("Should rewrite prefixes and regular expressions", func() {
+		urls := r.MirrorURLs("https", "/khadas-vim1/Noble_current_xfce", false)
+
+		Expect(urls["plain.example.com"]).To(Equal("https://plain.example.com/armbian/dl/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+		Expect(urls["split.example.com"]).To(Equal("https://split.example.com/armbian-dl/khadas-vim1/archive/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+		Expect(urls["flat.example.com"]).To(Equal("https://flat.example.com/armbian/images/Armbian_25.11.1_Khadas-vim1_noble_current_6.12.58_xfce_desktop.img.xz"))
+	})
+
+	It("Should only rewrite whole path segments", func() {
+		r.servers = ServerList{
+			newServer("segment.example.com", "/",
+				Rewrite{Prefix: "/armbian", Replace: "/mirror/armbian"},
+			),
+			r.servers[1],
+		}
+
+		urls := r.MirrorURLs("https", "/armbian-dl/file.img.xz", false)
+
+		Expect(urls["segment.example.com"]).To(Equal("https://segment.example.com/armbian-dl/file.img.xz"))
+
+		urls = r.MirrorURLs("https", "/armbian/file.img.xz", false)
+
+		Expect(urls["segment.example.com"]).To(Equal("https://segment.example.com/mirror/armbian/file.img.xz"))
+
+		// Joined paths lose their trailing slash, but still match the prefix
+		urls = r.MirrorURLs("https", "/dl", false)
+
+		Expect(urls["split.example.com"]).To(Equal("https://split.example.com/armbian-dl"))
+	})
+
+	It("Should reject invalid rewrites", func() {
+		_, err := compileRewrites([]Rewrite{{Replace: "/"}})
+		Expect(err).ToNot(BeNil())
+
+		_, err = compileRewrites([]Rewrite{{Prefix: "/a/", Match: "^/b/", Replace: "/"}})
+		Expect(err).ToNot(BeNil())
+
+		_, err = compileRewrites([]Rewrite{{Match: "(", Replace: "/"}})
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,215 @@
+package redirector
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rsyncProtocol is the protocol name servers declare to offer rsync.
+	rsyncProtocol = "rsync"
+
+	// rsyncPort is the default port of rsync daemons.
+	rsyncPort = "873"
+
+	// rsyncProtocolVersion is the protocol version sent in the rsync greeting.
+	rsyncProtocolVersion = "31.0"
+)
+
+// ErrRsyncModule is returned when the rsync daemon refuses the server's module.
+var ErrRsyncModule = errors.New("rsync module is not available")
+
+// RsyncCheck verifies the rsync daemon of servers offering rsync, by checking its banner and module.
+// It doesn't fail servers, it only updates whether rsync is offered.
+type RsyncCheck struct {
+	config *Config
+	port   string
+}
+
+// Check connects to the rsync daemon of a server, and requests its module.
+func (c *RsyncCheck) Check(server *Server, logFields log.Fields) (bool, error) {
+	if server.RsyncModule == "" {
+		return true, nil
+	}
+
+	err := c.checkDaemon(server)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if err != nil {
+		logFields["rsyncError"] = err
+		log.WithError(err).WithField("host", server.Host).Debug("Server rsync daemon is not available")
+		server.Protocols = Remove(server.Protocols, rsyncProtocol)
+	} else if !lo.Contains(server.Protocols, rsyncProtocol) {
+		server.Protocols = append(server.Protocols, rsyncProtocol)
+	}
+
+	// This check doesn't fail servers, it just updates their rsync status
+	return true, nil
+}
+
+// checkDaemon performs the rsync daemon greeting, and selects the module.
+func (c *RsyncCheck) checkDaemon(server *Server) error {
+	host := server.Host
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	port := c.port
+
+	if port == "" {
+		port = rsyncPort
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 10*time.Second)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	banner, err := reader.ReadString('\n')
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(banner, "@RSYNCD: ") {
+		return fmt.Errorf("unexpected rsync banner %q", strings.TrimSpace(banner))
+	}
+
+	// The module is the first part of the path, anything after it is a directory inside the module
+	module, _, _ := strings.Cut(server.RsyncModule, "/")
+
+	if _, err := fmt.Fprintf(conn, "@RSYNCD: %s\n%s\n", rsyncProtocolVersion, module); err != nil {
+		return err
+	}
+
+	// The daemon may send a motd before answering
+	for i := 0; i < 100; i++ {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "@RSYNCD: OK", strings.HasPrefix(line, "@RSYNCD: AUTHREQD"):
+			return nil
+		case strings.HasPrefix(line, "@ERROR"):
+			return fmt.Errorf("%w: %s", ErrRsyncModule, line)
+		case line == "@RSYNCD: EXIT":
+			return ErrRsyncModule
+		}
+	}
+
+	return ErrRsyncModule
+}
+
+// offersRsync returns true if the server's rsync daemon works for clients of an address family.
+// The caller must hold the read lock.
+func (s *Server) offersRsync(ipv6 bool) bool {
+	if s.RsyncModule == "" || !lo.Contains(s.Protocols, rsyncProtocol) {
+		return false
+	}
+
+	if ipv6 {
+		return !s.rsyncIPv6Broken
+	}
+
+	return !s.rsyncIPv4Broken
+}
+
+// rsyncURL returns the rsync url of a server.
+func (s *Server) rsyncURL(ipv6 bool) string {
+	host := s.hostFor(ipv6)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return "rsync://" + host + "/" + strings.Trim(s.RsyncModule, "/") + "/"
+}
+
+// RsyncServer is the response of the rsync discovery endpoint in json format.
+type RsyncServer struct {
+	URL       string  `json:"url"`
+	Host      string  `json:"host"`
+	Module    string  `json:"module"`
+	Distance  float64 `json:"distance"`
+	Continent string  `json:"continent"`
+	Country   string  `json:"country"`
+}
+
+// rsyncClosestHandler returns the rsync url of the closest healthy rsync server, so downstream
+// mirrors can pick their upstream automatically. It returns json with ?format=json or
+// an Accept: application/json header, and plain text otherwise.
+func (r *Redirector) rsyncClosestHandler(w http.ResponseWriter, req *http.Request) {
+	ip, err := clientIP(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ipv6 := isIPv6(ip)
+
+	ranked, err := r.servers.Rank(r, rsyncProtocol, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Rank only filters on the protocol, so rsync support is checked for the address family of the client
+	closest, ok := lo.Find(ranked, func(item ComputedDistance) bool {
+		item.Server.mu.RLock()
+		defer item.Server.mu.RUnlock()
+
+		return item.Server.Available && item.Server.offersRsync(ipv6)
+	})
+
+	if !ok {
+		http.Error(w, "No rsync server available", http.StatusNotFound)
+		return
+	}
+
+	u := closest.Server.rsyncURL(ipv6)
+
+	w.Header().Set("Cache-Control", "private, max-age=300")
+
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RsyncServer{
+			URL:       u,
+			Host:      closest.Server.Host,
+			Module:    closest.Server.RsyncModule,
+			Distance:  closest.Distance,
+			Continent: closest.Server.Continent,
+			Country:   closest.Server.Country,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(u + "\n"))
+}
@@ -0,0 +1,109 @@
+package redirector
+
+import (
+	"bufio"
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Rsync checks", func() {
+	var (
+		listener net.Listener
+		modules  []string
+		server   *Server
+		check    *RsyncCheck
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		modules = []string{"armbian"}
+
+		// A minimal rsync daemon, answering the greeting and module selection
+		go func() {
+			for {
+				conn, err := listener.Accept()
+
+				if err != nil {
+					return
+				}
+
+				go func(conn net.Conn) {
+					defer conn.Close()
+
+					conn.Write([]byte("@RSYNCD: 31.0 sha512 sha256 md5\n"))
+
+					reader := bufio.NewReader(conn)
+					reader.ReadString('\n')
+					module, _ := reader.ReadString('\n')
+					module = strings.TrimSpace(module)
+
+					conn.Write([]byte("Welcome to the test mirror\n\n"))
+
+					for _, m := range modules {
+						if m == module {
+							conn.Write([]byte("@RSYNCD: OK\n"))
+							return
+						}
+					}
+
+					conn.Write([]byte("@ERROR: Unknown module '" + module + "'\n"))
+				}(conn)
+			}
+		}()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+		server = &Server{
+			Host:        "127.0.0.1",
+			Protocols:   []string{"http", "https", rsyncProtocol},
+			RsyncModule: "armbian/apt",
+		}
+		check = &RsyncCheck{port: port}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("Should keep rsync for servers with a working module", func() {
+		res, err := check.Check(server, log.Fields{})
+
+		Expect(res).To(BeTrue())
+		Expect(err).To(BeNil())
+		Expect(server.Protocols).To(ContainElement(rsyncProtocol))
+	})
+
+	It("Should remove rsync for servers with a missing module, without failing them", func() {
+		modules = nil
+
+		res, err := check.Check(server, log.Fields{})
+
+		Expect(res).To(BeTrue())
+		Expect(err).To(BeNil())
+		Expect(server.Protocols).ToNot(ContainElement(rsyncProtocol))
+
+		Expect(check.checkDaemon(server)).To(MatchError(ErrRsyncModule))
+	})
+
+	It("Should check rsync on address family hosts", func() {
+		server.IPv4Host = "127.0.0.2"
+
+		Expect(server.checkStatus([]ServerCheck{check})).To(BeTrue())
+		Expect(server.Available).To(BeTrue())
+		Expect(server.IPv4Broken).To(BeFalse())
+		Expect(server.offersRsync(true)).To(BeTrue())
+		Expect(server.offersRsync(false)).To(BeFalse())
+	})
+
+	It("Should build rsync urls", func() {
+		Expect(server.rsyncURL(false)).To(Equal("rsync://127.0.0.1/armbian/apt/"))
+	})
+})
@@ -13,6 +13,7 @@ import (
 	"github.com/armbian/redirector/util"
 	"github.com/jmcvetta/randutil"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"github.com/sourcegraph/conc/pool"
@@ -20,21 +21,77 @@ import (
 
 // Server represents a download server
 type Server struct {
-	mu         sync.RWMutex       `json:"-"`
-	Available  bool               `json:"available"`
-	Reason     string             `json:"reason,omitempty"`
-	Host       string             `json:"host"`
-	Path       string             `json:"path"`
-	Latitude   float64            `json:"latitude"`
-	Longitude  float64            `json:"longitude"`
-	Weight     int                `json:"weight"`
-	Continent  string             `json:"continent"`
-	Country    string             `json:"country"`
-	Protocols  []string           `json:"protocols"`
-	IPv6       bool               `json:"ipv6"`
-	Rules      []Rule             `json:"rules,omitempty"`
-	Redirects  prometheus.Counter `json:"-"`
-	LastChange time.Time          `json:"lastChange"`
+	mu            sync.RWMutex       `json:"-"`
+	Available     bool               `json:"available"`
+	Reason        string             `json:"reason,omitempty"`
+	Host          string             `json:"host"`
+	Path          string             `json:"path"`
+	Latitude      float64            `json:"latitude"`
+	Longitude     float64            `json:"longitude"`
+	Weight        int                `json:"weight"`
+	Continent     string             `json:"continent"`
+	Country       string             `json:"country"`
+	Protocols     []string           `json:"protocols"`
+	IPv4Broken    bool               `json:"ipv4Broken,omitempty"`
+	IPv6          bool               `json:"ipv6"`
+	IPv4Host      string             `json:"ipv4Host,omitempty"`
+	IPv6Host      string             `json:"ipv6Host,omitempty"`
+	Global        bool               `json:"global,omitempty"`
+	Distance      float64            `json:"distance,omitempty"`
+	Rules         []Rule             `json:"rules,omitempty"`
+	Rewrites      []Rewrite          `json:"rewrites,omitempty"`
+	RsyncModule   string             `json:"rsyncModule,omitempty"`
+	Redirects     prometheus.Counter `json:"-"`
+	Failures      prometheus.Counter `json:"-"`
+	BytesServed   prometheus.Counter `json:"-"`
+	LastChange    time.Time          `json:"lastChange"`
+	LastCheck     time.Time          `json:"lastCheck"`
+	CheckResults  []CheckResult      `json:"-"`
+	Latency       time.Duration      `json:"-"`
+	LastSync      time.Time          `json:"-"`
+	MonthlyBudget int64              `json:"monthlyBudget,omitempty"`
+	MonthlyUsage  int64              `json:"monthlyUsage,omitempty"`
+	usagePeriod   string
+	uptime        uptimeHistory
+
+	// rsyncIPv4Broken and rsyncIPv6Broken are set when the rsync daemon fails on an address family host.
+	rsyncIPv4Broken bool
+	rsyncIPv6Broken bool
+}
+
+// registerMetrics creates the per-server metrics for a newly added server.
+func (s *Server) registerMetrics() {
+	name := metricReplacer.Replace(s.Host)
+
+	s.Redirects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_redirects_" + name,
+		Help: "The number of redirects for server " + s.Host,
+	})
+	s.Failures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_failures_" + name,
+		Help: "The number of client reported failures for server " + s.Host,
+	})
+	s.BytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "armbian_router_bytes_" + name,
+		Help: "The estimated number of bytes redirected to server " + s.Host,
+	})
+}
+
+// inherit carries over metrics and accumulated state from the server this one replaces on reload.
+func (s *Server) inherit(old *Server) {
+	s.Redirects = old.Redirects
+	s.Failures = old.Failures
+	s.BytesServed = old.BytesServed
+
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+
+	s.MonthlyUsage = old.MonthlyUsage
+	s.usagePeriod = old.usagePeriod
+	s.uptime = old.uptime
+	s.Latency = old.Latency
+	s.LastSync = old.LastSync
+	s.LastCheck = old.LastCheck
 }
 
 // ServerCheck is a check function which can return information about a status.
@@ -42,6 +99,25 @@ type ServerCheck interface {
 	Check(server *Server, logFields log.Fields) (bool, error)
 }
 
+// CheckResult is the result of a check in the last status check of a server.
+// Checks after the first failing one are not run.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkName returns the type name of a check, like HTTPCheck.
+func checkName(check ServerCheck) string {
+	checkType := reflect.TypeOf(check)
+
+	if checkType.Kind() == reflect.Ptr {
+		checkType = checkType.Elem()
+	}
+
+	return checkType.Name()
+}
+
 // checkStatus runs all status checks against a server
 // The return value of this isn't the availability, rather the change status
 // If true, the cache is flushed. If false, it does nothing.
@@ -53,28 +129,42 @@ func (s *Server) checkStatus(checks []ServerCheck) bool {
 	var res bool
 	var err error
 
+	results := make([]CheckResult, 0, len(checks))
+
 	for _, check := range checks {
 		res, err = check.Check(s, logFields)
 
+		result := CheckResult{
+			Name:   checkName(check),
+			Passed: res,
+		}
+
 		if err != nil {
 			logFields["error"] = err
+			result.Error = err.Error()
 		}
 
-		if !res {
-			checkType := reflect.TypeOf(check)
-
-			if checkType.Kind() == reflect.Ptr {
-				checkType = checkType.Elem()
-			}
+		results = append(results, result)
 
-			logFields["check"] = checkType.Name()
+		if !res {
+			logFields["check"] = result.Name
 			break
 		}
 	}
 
+	var familyChanged bool
+
+	if res {
+		familyChanged = s.checkFamilyHosts(checks)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.LastCheck = time.Now()
+	s.CheckResults = results
+	s.uptime.record(s.LastCheck, res)
+
 	if !res {
 		if s.Available {
 			log.WithFields(logFields).Info("Server is now unavailable")
@@ -104,7 +194,93 @@ func (s *Server) checkStatus(checks []ServerCheck) bool {
 		return true
 	}
 
-	return false
+	return familyChanged
+}
+
+// checkFamilyHosts runs the checks against the IPv4 and IPv6 specific hosts of a server.
+// A failing host only makes the server unavailable to clients of that address family.
+// It returns true if the availability for one of the families changed.
+func (s *Server) checkFamilyHosts(checks []ServerCheck) bool {
+	var changed bool
+
+	if s.IPv4Host != "" {
+		probe, ok := s.checkHost(s.IPv4Host, checks)
+
+		s.mu.Lock()
+		if s.IPv4Broken == ok {
+			log.WithFields(log.Fields{"host": s.Host, "ipv4Host": s.IPv4Host, "available": ok}).Info("Server IPv4 availability changed")
+			s.IPv4Broken = !ok
+			changed = true
+		}
+		s.rsyncIPv4Broken = s.rsyncLost(probe)
+		s.mu.Unlock()
+	}
+
+	if s.IPv6Host != "" {
+		probe, ok := s.checkHost(s.IPv6Host, checks)
+		ok = ok && probe.IPv6
+
+		s.mu.Lock()
+		if s.IPv6 != ok {
+			log.WithFields(log.Fields{"host": s.Host, "ipv6Host": s.IPv6Host, "available": ok}).Info("Server IPv6 availability changed")
+			s.IPv6 = ok
+			changed = true
+		}
+		s.rsyncIPv6Broken = s.rsyncLost(probe)
+		s.mu.Unlock()
+	}
+
+	return changed
+}
+
+// rsyncLost returns true if the server offers rsync, but the checks removed it from a probe.
+// The caller must hold the lock.
+func (s *Server) rsyncLost(probe *Server) bool {
+	return s.RsyncModule != "" && lo.Contains(s.Protocols, rsyncProtocol) && !lo.Contains(probe.Protocols, rsyncProtocol)
+}
+
+// checkHost runs the checks against another host name of the server, using a probe copy
+// so the checks can't modify the server itself.
+func (s *Server) checkHost(host string, checks []ServerCheck) (*Server, bool) {
+	s.mu.RLock()
+	probe := &Server{
+		Host:        host,
+		Path:        s.Path,
+		Protocols:   append([]string(nil), s.Protocols...),
+		RsyncModule: s.RsyncModule,
+	}
+	s.mu.RUnlock()
+
+	logFields := log.Fields{
+		"host": host,
+	}
+
+	for _, check := range checks {
+		res, err := check.Check(probe, logFields)
+
+		if !res {
+			log.WithFields(logFields).WithError(err).Debug("Server host check failed")
+			return probe, false
+		}
+	}
+
+	return probe, true
+}
+
+// hostFor returns the host name to redirect clients of an address family to.
+func (s *Server) hostFor(ipv6 bool) string {
+	if ipv6 && s.IPv6Host != "" {
+		return s.IPv6Host
+	} else if !ipv6 && s.IPv4Host != "" {
+		return s.IPv4Host
+	}
+
+	return s.Host
+}
+
+// hasHost returns true if the host is the server's host or one of its address family hosts.
+func (s *Server) hasHost(host string) bool {
+	return host == s.Host || (host != "" && (host == s.IPv4Host || host == s.IPv6Host))
 }
 
 // checkRUles takes input from a value match and checks the ruleset.
@@ -166,10 +342,29 @@ func (s ServerList) Check(r *Redirector, checks []ServerCheck) {
 
 	f := func(server *Server) func() {
 		return func() {
+			server.mu.RLock()
+			wasAvailable := server.Available
+			server.mu.RUnlock()
+
 			if !server.checkStatus(checks) {
 				return
 			}
 
+			server.mu.RLock()
+			event := ServerEvent{Host: server.Host, Reason: server.Reason}
+			available := server.Available
+			server.mu.RUnlock()
+
+			if available != wasAvailable {
+				eventType := EventServerDown
+
+				if available {
+					eventType = EventServerUp
+				}
+
+				r.events.publish(eventType, event)
+			}
+
 			// Clear cache, but only once
 			clearOnce.Do(func() {
 				r.serverCache.Purge()
@@ -192,133 +387,176 @@ type RuleInput struct {
 }
 
 // ComputedDistance is a wrapper that contains a Server and Distance.
+// Weight is the server's weight for the client, after budget and feedback adjustments.
 type ComputedDistance struct {
 	Server   *Server
 	Distance float64
+	Weight   int
 }
 
-// Closest uses GeoIP on the client's IP and compares the client's location
-// with that of the servers. If there are servers with the same country code,
-// it computes the distances. If the nearest server is within a threshold (e.g. 50km),
-// it is selected deterministically; otherwise, a weighted selection is used.
-// If no local servers exist, it falls back to a weighted selection among all valid servers.
-// If requireIPv6 is true, servers without IPv6 support are filtered out.
-func (s ServerList) Closest(r *Redirector, scheme string, ip net.IP, requireIPv6 bool) (*Server, float64, error) {
-	cacheKey := scheme + "_" + ip.String()
-	if requireIPv6 {
-		cacheKey += "_v6"
-	}
-
-	if cached, exists := r.serverCache.Get(cacheKey); exists {
-		if comp, ok := cached.(ComputedDistance); ok {
-			log.Infof("Cache hit: %s", comp.Server.Host)
-			return comp.Server, comp.Distance, nil
-		}
-		r.serverCache.Remove(cacheKey)
-	}
-
+// ruleInput looks up the location and ASN of a client ip.
+func (r *Redirector) ruleInput(ip net.IP) (RuleInput, error) {
 	var city db.City
 	if err := r.db.Lookup(ip, &city); err != nil {
 		log.WithError(err).Warning("Unable to lookup client location")
-		return nil, -1, err
+		return RuleInput{}, err
 	}
-	clientCountry := city.Country.IsoCode
 
 	var asn db.ASN
 	if r.asnDB != nil {
 		if err := r.asnDB.Lookup(ip, &asn); err != nil {
 			log.WithError(err).Warning("Unable to load ASN information")
-			return nil, -1, err
+			return RuleInput{}, err
 		}
 	}
 
-	ruleInput := RuleInput{
+	return RuleInput{
 		IP:       ip.String(),
 		ASN:      asn,
 		Location: city,
+	}, nil
+}
+
+// candidates filters the servers usable by a client, and computes their distance and weight.
+// all holds every valid server, sorted by distance. If there are servers in the client's country,
+// local holds those (and global servers, which are equidistant to every client), sorted by distance.
+// If requireIPv6 is true, servers without IPv6 support are filtered out.
+// Hosts in exclude are skipped. If fallback is true and less than two servers are valid,
+// every server but the excluded ones is used instead, so a single redirect always has a target.
+func (s ServerList) candidates(r *Redirector, scheme string, ip net.IP, requireIPv6 bool, exclude []string, fallback bool) ([]ComputedDistance, []ComputedDistance, error) {
+	ruleInput, err := r.ruleInput(ip)
+	if err != nil {
+		return nil, nil, err
 	}
+	city := ruleInput.Location
+	clientCountry := city.Country.IsoCode
 
 	validServers := lo.Filter(s, func(server *Server, _ int) bool {
 		if !server.Available || !lo.Contains(server.Protocols, scheme) {
 			return false
 		}
 
+		if server.overBudget() {
+			log.WithField("host", server.Host).Debug("Skipping server due to exhausted monthly budget")
+			return false
+		}
+
+		if lo.ContainsBy(exclude, server.hasHost) {
+			log.WithField("host", server.Host).Debug("Skipping server excluded by client")
+			return false
+		}
+
 		// If user is on IPv6, filter out servers that don't support IPv6
 		if requireIPv6 && !server.IPv6 {
 			log.WithField("host", server.Host).Debug("Skipping server due to no IPv6 support")
 			return false
 		}
+		if !requireIPv6 && server.IPv4Broken {
+			log.WithField("host", server.Host).Debug("Skipping server due to unavailable IPv4 host")
+			return false
+		}
 		if len(server.Rules) > 0 && !server.checkRules(ruleInput) {
 			log.WithField("host", server.Host).Debug("Skipping server due to rules")
 			return false
 		}
+		if r.feedback.demoted(server, ruleInput) {
+			log.WithField("host", server.Host).Debug("Skipping server due to client feedback")
+			return false
+		}
 		return true
 	})
 
-	if len(validServers) < 2 {
-		validServers = s
+	if fallback && len(validServers) < 2 {
+		validServers = lo.Filter(s, func(server *Server, _ int) bool {
+			return !lo.ContainsBy(exclude, server.hasHost)
+		})
+
+		if len(validServers) == 0 {
+			validServers = s
+		}
 	}
 
-	localServers := lo.Filter(validServers, func(server *Server, _ int) bool {
-		return server.Country == clientCountry
+	all := lo.Map(validServers, func(server *Server, _ int) ComputedDistance {
+		d := r.serverDistance(server, city.Location)
+		return ComputedDistance{
+			Server:   server,
+			Distance: d,
+			Weight:   r.feedback.weight(server, ruleInput),
+		}
 	})
 
-	if len(localServers) > 0 {
-		computedLocal := lo.Map(localServers, func(server *Server, _ int) ComputedDistance {
-			d := Distance(city.Location.Latitude, city.Location.Longitude, server.Latitude, server.Longitude)
-			return ComputedDistance{
-				Server:   server,
-				Distance: d,
-			}
-		})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Distance < all[j].Distance
+	})
 
-		sort.Slice(computedLocal, func(i, j int) bool {
-			return computedLocal[i].Distance < computedLocal[j].Distance
-		})
+	hasLocal := lo.ContainsBy(all, func(item ComputedDistance) bool {
+		return !item.Server.Global && item.Server.Country == clientCountry
+	})
 
-		if computedLocal[0].Distance < r.config.SameCityThreshold {
-			chosen := computedLocal[0]
-			r.serverCache.Add(cacheKey, chosen)
-			return chosen.Server, chosen.Distance, nil
-		}
+	if !hasLocal {
+		return nil, all, nil
+	}
 
-		choiceCount := r.config.TopChoices
-		if len(computedLocal) < choiceCount {
-			choiceCount = len(computedLocal)
-		}
+	// Global servers are equidistant to every client, so they join the local candidates as well
+	local := lo.Filter(all, func(item ComputedDistance, _ int) bool {
+		return item.Server.Global || item.Server.Country == clientCountry
+	})
 
-		choices := make([]randutil.Choice, choiceCount)
-		for i, item := range computedLocal[:choiceCount] {
-			choices[i] = randutil.Choice{
-				Weight: item.Server.Weight,
-				Item:   item,
-			}
-		}
+	return local, all, nil
+}
 
-		choice, err := randutil.WeightedChoice(choices)
-		if err != nil {
-			log.WithError(err).Warning("Unable to choose a weighted choice")
-			return nil, -1, err
+// closestCacheKey returns the key of a client in the server cache.
+func closestCacheKey(scheme string, ip net.IP, requireIPv6 bool) string {
+	cacheKey := scheme + "_" + ip.String()
+	if requireIPv6 {
+		cacheKey += "_v6"
+	}
+
+	return cacheKey
+}
+
+// Closest uses GeoIP on the client's IP and compares the client's location
+// with that of the servers. If there are servers with the same country code,
+// it computes the distances. If the nearest server is within a threshold (e.g. 50km),
+// it is selected deterministically; otherwise, a weighted selection is used.
+// If no local servers exist, it falls back to a weighted selection among all valid servers.
+// If requireIPv6 is true, servers without IPv6 support are filtered out.
+// Hosts in exclude are skipped; such requests bypass the cache, as the choice only applies to them.
+func (s ServerList) Closest(r *Redirector, scheme string, ip net.IP, requireIPv6 bool, exclude []string) (*Server, float64, error) {
+	cacheKey := closestCacheKey(scheme, ip, requireIPv6)
+	useCache := len(exclude) == 0
+
+	if useCache {
+		if cached, exists := r.serverCache.Get(cacheKey); exists {
+			// Servers which went down or used up their budget since they were cached are chosen again
+			if comp, ok := cached.(ComputedDistance); ok && comp.Server.Available && !comp.Server.overBudget() {
+				log.Infof("Cache hit: %s", comp.Server.Host)
+				return comp.Server, comp.Distance, nil
+			}
+			r.serverCache.Remove(cacheKey)
 		}
+	}
 
-		dist := choice.Item.(ComputedDistance)
-		r.serverCache.Add(cacheKey, dist)
-		return dist.Server, dist.Distance, nil
+	local, all, err := s.candidates(r, scheme, ip, requireIPv6, exclude, true)
+	if err != nil {
+		return nil, -1, err
 	}
 
-	// Fallback: if no local servers exist, simply select the nearest server among all valid servers.
-	computed := lo.Map(validServers, func(server *Server, _ int) ComputedDistance {
-		d := Distance(city.Location.Latitude, city.Location.Longitude, server.Latitude, server.Longitude)
-		return ComputedDistance{
-			Server:   server,
-			Distance: d,
+	computed := all
+
+	if len(local) > 0 {
+		if local[0].Distance < r.config.SameCityThreshold {
+			chosen := local[0]
+			if useCache {
+				r.serverCache.Add(cacheKey, chosen)
+			}
+			return chosen.Server, chosen.Distance, nil
 		}
-	})
 
-	sort.Slice(computed, func(i, j int) bool {
-		return computed[i].Distance < computed[j].Distance
-	})
+		computed = local
+	}
 
+	// Select among the top choices, based on weight
 	choiceCount := r.config.TopChoices
 	if len(computed) < choiceCount {
 		choiceCount = len(computed)
@@ -327,7 +565,7 @@ func (s ServerList) Closest(r *Redirector, scheme string, ip net.IP, requireIPv6
 	choices := make([]randutil.Choice, choiceCount)
 	for i, item := range computed[:choiceCount] {
 		choices[i] = randutil.Choice{
-			Weight: item.Server.Weight,
+			Weight: item.Weight,
 			Item:   item,
 		}
 	}
@@ -339,10 +577,47 @@ func (s ServerList) Closest(r *Redirector, scheme string, ip net.IP, requireIPv6
 	}
 
 	dist := choice.Item.(ComputedDistance)
-	r.serverCache.Add(cacheKey, dist)
+	if useCache {
+		r.serverCache.Add(cacheKey, dist)
+	}
 	return dist.Server, dist.Distance, nil
 }
 
+// Rank returns the candidate servers for a client in order of preference, using the same filtering as Closest.
+// Unlike Closest, it never falls back to unhealthy servers, so it can be empty.
+// Local servers come first, followed by the remaining servers, each sorted by distance.
+func (s ServerList) Rank(r *Redirector, scheme string, ip net.IP, requireIPv6 bool, exclude []string) ([]ComputedDistance, error) {
+	local, all, err := s.candidates(r, scheme, ip, requireIPv6, exclude, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make([]ComputedDistance, 0, len(all))
+	ranked = append(ranked, local...)
+
+	for _, item := range all {
+		if !lo.ContainsBy(local, func(l ComputedDistance) bool { return l.Server == item.Server }) {
+			ranked = append(ranked, item)
+		}
+	}
+
+	return ranked, nil
+}
+
+// serverDistance returns the distance between a client location and a server.
+// Global servers have the same, configured distance to every client.
+func (r *Redirector) serverDistance(server *Server, location db.Location) float64 {
+	if server.Global {
+		if server.Distance > 0 {
+			return server.Distance
+		}
+
+		return r.config.GlobalDistance
+	}
+
+	return Distance(location.Latitude, location.Longitude, server.Latitude, server.Longitude)
+}
+
 // haversin(θ) function
 func hsin(theta float64) float64 {
 	return math.Pow(math.Sin(theta/2), 2)
@@ -0,0 +1,263 @@
+package redirector
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"time"
+
+	"github.com/armbian/redirector/db"
+	lru "github.com/hashicorp/golang-lru"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// hostCheck is a ServerCheck which fails for a set of hosts.
+// Like IPv6Check, it reports IPv6 support for hosts without an IPv6 specific host.
+type hostCheck struct {
+	failing map[string]bool
+}
+
+func (h *hostCheck) Check(server *Server, logFields log.Fields) (bool, error) {
+	if server.IPv6Host == "" {
+		server.IPv6 = true
+	}
+
+	if h.failing[server.Host] {
+		return false, errors.New("host is down")
+	}
+
+	return true, nil
+}
+
+// fakeGeo is a geoReader returning fixed locations, keyed by client IP.
+type fakeGeo map[string]db.City
+
+func (f fakeGeo) Lookup(ip net.IP, result any) error {
+	if city, ok := result.(*db.City); ok {
+		*city = f[ip.String()]
+	}
+
+	return nil
+}
+
+func (f fakeGeo) Close() error {
+	return nil
+}
+
+// berlinClient and parisClient are client IPs located in Berlin and Paris by testGeo.
+const (
+	berlinClient = "192.0.2.10"
+	parisClient  = "198.51.100.10"
+)
+
+var testGeo = fakeGeo{
+	berlinClient: {
+		Country:  db.Country{IsoCode: "DE"},
+		Location: db.Location{Latitude: 52.52, Longitude: 13.40},
+	},
+	parisClient: {
+		Country:  db.Country{IsoCode: "FR"},
+		Location: db.Location{Latitude: 48.86, Longitude: 2.35},
+	},
+}
+
+// newGeoRedirector returns a redirector using testGeo, with mirrors in Berlin, Munich and Paris.
+func newGeoRedirector() *Redirector {
+	r := New(&Config{TopChoices: 3, SameCityThreshold: 50000})
+	r.db = testGeo
+	r.serverCache, _ = lru.New(16)
+	r.servers = ServerList{
+		{Host: "berlin.example.com", Path: "/apt/", Available: true, Protocols: []string{"http", "https"}, Country: "DE", Latitude: 52.52, Longitude: 13.40, Weight: 10},
+		{Host: "munich.example.com", Path: "/apt/", Available: true, Protocols: []string{"http", "https"}, Country: "DE", Latitude: 48.14, Longitude: 11.58, Weight: 10},
+		{Host: "paris.example.com", Path: "/apt/", Available: true, Protocols: []string{"http", "https"}, Country: "FR", Latitude: 48.86, Longitude: 2.35, Weight: 10},
+	}
+	r.hostMap = make(map[string]*Server)
+
+	for _, server := range r.servers {
+		r.hostMap[server.Host] = server
+	}
+
+	return r
+}
+
+var _ = Describe("Servers", func() {
+	Context("Address family hosts", func() {
+		var (
+			server *Server
+			check  *hostCheck
+		)
+
+		BeforeEach(func() {
+			server = &Server{
+				Available: true,
+				Host:      "mirror.example.com",
+				IPv6:      true,
+				IPv4Host:  "ipv4.mirror.example.com",
+				IPv6Host:  "ipv6.mirror.example.com",
+			}
+			check = &hostCheck{failing: make(map[string]bool)}
+		})
+
+		It("Should redirect to the host of the client's address family", func() {
+			Expect(server.hostFor(false)).To(Equal("ipv4.mirror.example.com"))
+			Expect(server.hostFor(true)).To(Equal("ipv6.mirror.example.com"))
+
+			server.IPv6Host = ""
+
+			Expect(server.hostFor(true)).To(Equal("mirror.example.com"))
+		})
+
+		It("Should only drop the family with a broken host", func() {
+			check.failing["ipv6.mirror.example.com"] = true
+
+			Expect(server.checkStatus([]ServerCheck{check})).To(BeTrue())
+			Expect(server.Available).To(BeTrue())
+			Expect(server.IPv4Broken).To(BeFalse())
+			Expect(server.IPv6).To(BeFalse())
+
+			Expect(server.checkStatus([]ServerCheck{check})).To(BeFalse())
+
+			delete(check.failing, "ipv6.mirror.example.com")
+
+			Expect(server.checkStatus([]ServerCheck{check})).To(BeTrue())
+			Expect(server.IPv6).To(BeTrue())
+		})
+
+		It("Should match excluded hosts against all host names", func() {
+			Expect(server.hasHost("mirror.example.com")).To(BeTrue())
+			Expect(server.hasHost("ipv6.mirror.example.com")).To(BeTrue())
+			Expect(server.hasHost("other.example.com")).To(BeFalse())
+			Expect(server.hasHost("")).To(BeFalse())
+		})
+	})
+
+	It("Should keep check state across reloads", func() {
+		old := &Server{Host: "mirror.example.com", LastCheck: time.Now(), Latency: time.Second}
+		server := &Server{Host: "mirror.example.com"}
+
+		server.inherit(old)
+
+		Expect(server.LastCheck).To(Equal(old.LastCheck))
+		Expect(server.Latency).To(Equal(time.Second))
+	})
+
+	Context("Global servers", func() {
+		var r *Redirector
+
+		BeforeEach(func() {
+			r = New(&Config{GlobalDistance: 1000000})
+		})
+
+		It("Should use the same distance for every client", func() {
+			server := &Server{Global: true}
+
+			Expect(r.serverDistance(server, db.Location{Latitude: 52.52, Longitude: 13.40})).To(Equal(1000000.0))
+			Expect(r.serverDistance(server, db.Location{Latitude: -33.86, Longitude: 151.20})).To(Equal(1000000.0))
+
+			server.Distance = 250000
+
+			Expect(r.serverDistance(server, db.Location{Latitude: 52.52, Longitude: 13.40})).To(Equal(250000.0))
+		})
+
+		It("Should geolocate other servers", func() {
+			server := &Server{Latitude: 52.52, Longitude: 13.40}
+
+			Expect(r.serverDistance(server, db.Location{Latitude: 52.52, Longitude: 13.40})).To(BeZero())
+		})
+	})
+
+	Context("Closest", func() {
+		var r *Redirector
+
+		BeforeEach(func() {
+			r = newGeoRedirector()
+			r.servers[0].Failures = prometheus.NewCounter(prometheus.CounterOpts{Name: "failures_berlin"})
+		})
+
+		It("Should skip excluded hosts without caching the choice", func() {
+			ip := net.ParseIP(berlinClient)
+
+			server, _, err := r.servers.Closest(r, "https", ip, false, []string{"berlin.example.com"})
+
+			Expect(err).To(BeNil())
+			Expect(server.Host).To(Equal("munich.example.com"))
+			Expect(r.serverCache.Len()).To(BeZero())
+
+			server, _, err = r.servers.Closest(r, "https", ip, false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(server.Host).To(Equal("berlin.example.com"))
+			Expect(r.serverCache.Contains("https_" + berlinClient)).To(BeTrue())
+		})
+
+		It("Should not return cached servers which are unavailable or over budget", func() {
+			ip := net.ParseIP(berlinClient)
+			berlin, munich := r.servers[0], r.servers[1]
+
+			server, _, err := r.servers.Closest(r, "https", ip, false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(server).To(Equal(berlin))
+
+			berlin.MonthlyBudget = 100
+			berlin.addUsage(100)
+
+			server, _, err = r.servers.Closest(r, "https", ip, false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(server).To(Equal(munich))
+
+			berlin.MonthlyBudget = 0
+			munich.Available = false
+
+			server, _, err = r.servers.Closest(r, "https", ip, false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(server).To(Equal(berlin))
+		})
+
+		It("Should only rank healthy servers", func() {
+			r.servers[0].Available = false
+			r.servers[1].Available = false
+
+			ranked, err := r.servers.Rank(r, "https", net.ParseIP(berlinClient), false, nil)
+
+			Expect(err).To(BeNil())
+			Expect(ranked).To(HaveLen(1))
+			Expect(ranked[0].Server.Host).To(Equal("paris.example.com"))
+		})
+
+		It("Should count a failure once per client and host", func() {
+			req := httptest.NewRequest("GET", "/file?exclude=berlin.example.com,unknown.example.com", nil)
+
+			Expect(r.excludedHosts(req, net.ParseIP(berlinClient))).To(Equal([]string{"berlin.example.com", "unknown.example.com"}))
+			Expect(r.excludedHosts(req, net.ParseIP(berlinClient))).To(HaveLen(2))
+			Expect(counterValue(r.servers[0].Failures)).To(Equal(1.0))
+
+			r.excludedHosts(req, net.ParseIP("192.0.2.20"))
+
+			Expect(counterValue(r.servers[0].Failures)).To(Equal(2.0))
+		})
+
+		It("Should skip excluded hosts in region redirects", func() {
+			for _, server := range r.servers {
+				server.Redirects = prometheus.NewCounter(prometheus.CounterOpts{Name: "redirects"})
+			}
+
+			r.regionMap = map[string][]*Server{"EU": {r.servers[0], r.servers[1]}}
+
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest("GET", "/region/EU/file?exclude=berlin.example.com", nil)
+				req.RemoteAddr = berlinClient + ":1234"
+
+				w := httptest.NewRecorder()
+				r.redirectHandler(w, req)
+
+				Expect(w.Header().Get("Location")).To(HavePrefix("http://munich.example.com/"))
+			}
+		})
+	})
+})
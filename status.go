@@ -0,0 +1,149 @@
+package redirector
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	//go:embed assets/status.html
+	statusHTML string
+
+	statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(statusHTML))
+
+	continentNames = map[string]string{
+		"AF": "Africa",
+		"AN": "Antarctica",
+		"AS": "Asia",
+		"EU": "Europe",
+		"NA": "North America",
+		"OC": "Oceania",
+		"SA": "South America",
+	}
+)
+
+// statusPage is the data of the mirror status page.
+type statusPage struct {
+	Generated  time.Time
+	Total      int
+	Available  int
+	Continents []statusContinent
+}
+
+// statusContinent is a group of servers on the status page.
+type statusContinent struct {
+	Name    string
+	Servers []statusServer
+}
+
+// statusServer is a copy of the server state shown on the status page.
+type statusServer struct {
+	Host       string
+	Country    string
+	Available  bool
+	Reason     string
+	LastChange time.Time
+	Protocols  []string
+	IPv6       bool
+	Weight     int
+	Redirects  uint64
+}
+
+// counterValue returns the current value of a counter, or 0 if it is not set.
+func counterValue(c prometheus.Counter) float64 {
+	if c == nil {
+		return 0
+	}
+
+	var m dto.Metric
+
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+// newStatusPage groups a snapshot of the servers by continent, sorted by continent and host.
+func newStatusPage(servers ServerList) statusPage {
+	page := statusPage{
+		Generated: time.Now(),
+		Total:     len(servers),
+	}
+
+	continents := make(map[string][]statusServer)
+
+	for _, server := range servers {
+		server.mu.RLock()
+		s := statusServer{
+			Host:       server.Host,
+			Country:    server.Country,
+			Available:  server.Available,
+			Reason:     server.Reason,
+			LastChange: server.LastChange,
+			Protocols:  append([]string(nil), server.Protocols...),
+			IPv6:       server.IPv6,
+			Weight:     server.Weight,
+			Redirects:  uint64(counterValue(server.Redirects)),
+		}
+		continent := server.Continent
+		server.mu.RUnlock()
+
+		if s.Available {
+			page.Available++
+		}
+
+		if server.Global {
+			continent = "Global"
+		}
+
+		continents[continent] = append(continents[continent], s)
+	}
+
+	for continent, list := range continents {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Host < list[j].Host
+		})
+
+		name, ok := continentNames[continent]
+
+		if !ok {
+			name = continent
+		}
+
+		if name == "" {
+			name = "Unknown"
+		}
+
+		page.Continents = append(page.Continents, statusContinent{
+			Name:    name,
+			Servers: list,
+		})
+	}
+
+	sort.Slice(page.Continents, func(i, j int) bool {
+		return page.Continents[i].Name < page.Continents[j].Name
+	})
+
+	return page
+}
+
+// mirrorStatusPageHandler renders the status page of all mirrors, grouped by continent.
+func (r *Redirector) mirrorStatusPageHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := statusTemplate.Execute(w, newStatusPage(r.servers)); err != nil {
+		log.WithError(err).Warning("Unable to render status page")
+	}
+}
@@ -0,0 +1,41 @@
+package redirector
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Status page", func() {
+	It("Should group servers by continent", func() {
+		redirects := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_redirects"})
+		redirects.Add(42)
+
+		servers := ServerList{
+			{Host: "mirror-b.example.com", Continent: "EU", Country: "DE", Available: true, Weight: 10, Protocols: []string{"http", "https"}, Redirects: redirects},
+			{Host: "mirror-a.example.com", Continent: "EU", Country: "IT", Reason: "Unexpected http status code", Weight: 5},
+			{Host: "mirror.example.org", Continent: "NA", Country: "US", Available: true, Weight: 10},
+			{Host: "github.com", Global: true, Available: true, Weight: 1},
+		}
+
+		page := newStatusPage(servers)
+
+		Expect(page.Total).To(Equal(4))
+		Expect(page.Available).To(Equal(3))
+		Expect(page.Continents).To(HaveLen(3))
+		Expect(page.Continents[0].Name).To(Equal("Europe"))
+		Expect(page.Continents[0].Servers[0].Host).To(Equal("mirror-a.example.com"))
+		Expect(page.Continents[0].Servers[1].Redirects).To(Equal(uint64(42)))
+		Expect(page.Continents[1].Name).To(Equal("Global"))
+		Expect(page.Continents[2].Name).To(Equal("North America"))
+
+		var buf bytes.Buffer
+
+		Expect(statusTemplate.Execute(&buf, page)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("Unexpected http status code"))
+		Expect(buf.String()).To(ContainSubstring("http, https"))
+		Expect(buf.String()).ToNot(ContainSubstring("<script"))
+	})
+})
@@ -0,0 +1,292 @@
+package redirector
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// torrentExtension is the extension of torrent companions in the download map.
+	torrentExtension = ".torrent"
+
+	// defaultWebSeeds is the number of mirrors added as web seeds to a torrent.
+	defaultWebSeeds = 5
+
+	// maxTorrentSize is the maximum size of a torrent file to fetch.
+	maxTorrentSize = 4 << 20
+
+	// torrentCacheSize is the number of torrent files to keep in memory.
+	torrentCacheSize = 256
+
+	// torrentRetryDelay is how long a failed torrent download is remembered before it is retried.
+	torrentRetryDelay = 5 * time.Minute
+
+	// maxTorrentDepth is the maximum nesting of lists and dictionaries in a torrent file.
+	maxTorrentDepth = 64
+)
+
+// ErrInvalidTorrent is returned when a torrent file can't be decoded.
+var ErrInvalidTorrent = errors.New("invalid torrent file")
+
+// torrentFailure is a failed torrent download, remembered until torrentRetryDelay passed.
+type torrentFailure struct {
+	err error
+	at  time.Time
+}
+
+// torrentStore caches the original torrent files of mapped images, and failures to load them.
+// It is reset on every map reload.
+type torrentStore struct {
+	config   *Config
+	torrents *lru.Cache
+	failures *lru.Cache
+}
+
+func newTorrentStore(config *Config) *torrentStore {
+	torrents, _ := lru.New(torrentCacheSize)
+	failures, _ := lru.New(torrentCacheSize)
+
+	return &torrentStore{
+		config:   config,
+		torrents: torrents,
+		failures: failures,
+	}
+}
+
+// reset drops all cached torrents and failures.
+func (t *torrentStore) reset() {
+	t.torrents.Purge()
+	t.failures.Purge()
+}
+
+// get returns a torrent file, fetching it if it isn't cached.
+// Failures are cached for torrentRetryDelay, so requests fall back to a redirect without waiting on the download.
+func (t *torrentStore) get(torrentURL string) ([]byte, error) {
+	if v, ok := t.torrents.Get(torrentURL); ok {
+		return v.([]byte), nil
+	}
+
+	if v, ok := t.failures.Get(torrentURL); ok {
+		if failure := v.(torrentFailure); time.Since(failure.at) < torrentRetryDelay {
+			return nil, failure.err
+		}
+	}
+
+	b, err := fetchCompanion(t.config, torrentURL, maxTorrentSize)
+
+	// Validate before caching, so broken files are fetched again
+	if err == nil {
+		_, err = decodeDict(b)
+	}
+
+	if err != nil {
+		t.failures.Add(torrentURL, torrentFailure{err: err, at: time.Now()})
+		return nil, err
+	}
+
+	t.failures.Remove(torrentURL)
+	t.torrents.Add(torrentURL, b)
+
+	return b, nil
+}
+
+// torrentHandler serves the torrent of a mapped image with the client's closest mirrors as BEP 19 web seeds.
+// It returns false if the torrent couldn't be served, so the request can fall back to a redirect.
+func (r *Redirector) torrentHandler(w http.ResponseWriter, req *http.Request, ip net.IP, key string, file *ReleaseFile) bool {
+	original, err := r.torrents.get(file.FileURLTorrent)
+
+	if err != nil {
+		log.WithError(err).WithField("url", file.FileURLTorrent).Warning("Unable to load torrent")
+		return false
+	}
+
+	scheme := requestScheme(req)
+	ipv6 := isIPv6(ip)
+
+	ranked, err := r.servers.Rank(r, scheme, ip, ipv6, nil)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to rank servers")
+		return false
+	}
+
+	n := queryInt(req, "n", defaultWebSeeds, len(r.servers))
+
+	var seeds []string
+
+	for _, item := range r.rankedURLs(ranked, scheme, key, ipv6, n) {
+		seeds = append(seeds, item.Target.URL)
+	}
+
+	torrent, err := webSeedTorrent(original, seeds)
+
+	if err != nil {
+		log.WithError(err).WithField("url", file.FileURLTorrent).Warning("Unable to add web seeds to torrent")
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(file.FileURLTorrent)+"\"")
+	w.Header().Set("Content-Length", strconv.Itoa(len(torrent)))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(torrent)
+
+	return true
+}
+
+// webSeedTorrent replaces the url-list (BEP 19 web seeds) of a torrent.
+// All other keys, including the info dictionary, are kept byte for byte, so the info-hash stays stable.
+func webSeedTorrent(torrent []byte, seeds []string) ([]byte, error) {
+	dict, err := decodeDict(torrent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := dict["info"]; !ok {
+		return nil, ErrInvalidTorrent
+	}
+
+	var list bytes.Buffer
+
+	list.WriteByte('l')
+
+	for _, seed := range seeds {
+		writeString(&list, seed)
+	}
+
+	list.WriteByte('e')
+
+	dict["url-list"] = list.Bytes()
+
+	return encodeDict(dict), nil
+}
+
+// decodeDict decodes a bencoded dictionary into its raw, still encoded, values.
+func decodeDict(b []byte) (map[string][]byte, error) {
+	if len(b) < 2 || b[0] != 'd' {
+		return nil, ErrInvalidTorrent
+	}
+
+	dict := make(map[string][]byte)
+
+	i := 1
+
+	for i < len(b) && b[i] != 'e' {
+		keyEnd, err := valueEnd(b, i, 0)
+
+		if err != nil || b[i] < '0' || b[i] > '9' {
+			return nil, ErrInvalidTorrent
+		}
+
+		key := b[bytes.IndexByte(b[i:], ':')+i+1 : keyEnd]
+
+		end, err := valueEnd(b, keyEnd, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dict[string(key)] = b[keyEnd:end]
+
+		i = end
+	}
+
+	if i != len(b)-1 {
+		return nil, ErrInvalidTorrent
+	}
+
+	return dict, nil
+}
+
+// valueEnd returns the index after the bencoded value starting at i, nested depth levels deep.
+func valueEnd(b []byte, i, depth int) (int, error) {
+	if i >= len(b) || depth > maxTorrentDepth {
+		return 0, ErrInvalidTorrent
+	}
+
+	switch c := b[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(b[i:], 'e')
+
+		if end < 0 {
+			return 0, ErrInvalidTorrent
+		}
+
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+
+		for i < len(b) && b[i] != 'e' {
+			end, err := valueEnd(b, i, depth+1)
+
+			if err != nil {
+				return 0, err
+			}
+
+			i = end
+		}
+
+		if i >= len(b) {
+			return 0, ErrInvalidTorrent
+		}
+
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b[i:], ':')
+
+		if colon < 0 {
+			return 0, ErrInvalidTorrent
+		}
+
+		length, err := strconv.Atoi(string(b[i : i+colon]))
+
+		if err != nil || length < 0 || length > len(b)-(i+colon+1) {
+			return 0, ErrInvalidTorrent
+		}
+
+		return i + colon + 1 + length, nil
+	}
+
+	return 0, ErrInvalidTorrent
+}
+
+// encodeDict bencodes a dictionary of raw values, with its keys sorted as the format requires.
+func encodeDict(dict map[string][]byte) []byte {
+	keys := make([]string, 0, len(dict))
+
+	for key := range dict {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+
+	buf.WriteByte('d')
+
+	for _, key := range keys {
+		writeString(&buf, key)
+		buf.Write(dict[key])
+	}
+
+	buf.WriteByte('e')
+
+	return buf.Bytes()
+}
+
+// writeString writes a bencoded string.
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
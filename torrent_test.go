@@ -0,0 +1,81 @@
+package redirector
+
+import (
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Torrents", func() {
+	// Keys are intentionally unsorted in the info dictionary, which must be kept as is
+	const info = "d6:lengthi1024e4:name14:Armbian.img.xz12:piece lengthi262144e6:pieces20:aaaaaaaaaaaaaaaaaaaa5:a keyi1ee"
+	const torrent = "d8:announce30:udp://tracker.example.com:69698:url-listl29:https://seed.example.com/old/e4:info" + info + "e"
+
+	It("Should replace the web seeds", func() {
+		b, err := webSeedTorrent([]byte(torrent), []string{
+			"https://mirror.example.com/Armbian.img.xz",
+			"https://other.example.com/Armbian.img.xz",
+		})
+
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("d8:announce30:udp://tracker.example.com:69694:info" + info +
+			"8:url-listl41:https://mirror.example.com/Armbian.img.xz40:https://other.example.com/Armbian.img.xzee"))
+	})
+
+	It("Should keep the info-hash stable", func() {
+		b, err := webSeedTorrent([]byte(torrent), []string{"https://mirror.example.com/Armbian.img.xz"})
+
+		Expect(err).To(BeNil())
+
+		dict, err := decodeDict(b)
+
+		Expect(err).To(BeNil())
+		Expect(sha1.Sum(dict["info"])).To(Equal(sha1.Sum([]byte(info))))
+	})
+
+	It("Should reject invalid torrents", func() {
+		for _, data := range []string{
+			"",
+			"le",
+			"d4:info",
+			"d4:infod4:name5:abce",
+			"d8:announce3:abce",
+			"di1e4:infodee",
+			"d4:infodee trailing",
+			"d9223372036854775807:ae",
+			"d4:info" + strings.Repeat("l", 100000) + strings.Repeat("e", 100001),
+		} {
+			_, err := webSeedTorrent([]byte(data), nil)
+			Expect(err).To(Equal(ErrInvalidTorrent), data)
+		}
+	})
+
+	It("Should cache failures to load torrents", func() {
+		var requests int
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte("not a torrent"))
+		}))
+		defer server.Close()
+
+		store := newTorrentStore(&Config{})
+
+		for i := 0; i < 2; i++ {
+			_, err := store.get(server.URL + "/Armbian.img.xz.torrent")
+			Expect(err).To(Equal(ErrInvalidTorrent))
+		}
+
+		Expect(requests).To(Equal(1))
+
+		store.reset()
+
+		_, err := store.get(server.URL + "/Armbian.img.xz.torrent")
+		Expect(err).To(Equal(ErrInvalidTorrent))
+		Expect(requests).To(Equal(2))
+	})
+})
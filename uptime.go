@@ -0,0 +1,72 @@
+package redirector
+
+import "time"
+
+// uptimeDays is the number of days of check results kept per server.
+const uptimeDays = 30
+
+// uptimeDay counts the check results of a day (UTC).
+type uptimeDay struct {
+	day   int64
+	up    int
+	total int
+}
+
+// uptimeHistory keeps the daily check results of a server, in a ring indexed by day.
+// It is guarded by the server's lock.
+type uptimeHistory struct {
+	days [uptimeDays]uptimeDay
+}
+
+// dayNumber returns the number of days since the unix epoch.
+func dayNumber(t time.Time) int64 {
+	return t.Unix() / 86400
+}
+
+// record adds a check result.
+func (h *uptimeHistory) record(now time.Time, up bool) {
+	day := dayNumber(now)
+	slot := &h.days[day%uptimeDays]
+
+	if slot.day != day {
+		*slot = uptimeDay{day: day}
+	}
+
+	slot.total++
+
+	if up {
+		slot.up++
+	}
+}
+
+// ratio returns the fraction of successful checks over the last days (including today),
+// and false if there were no checks.
+func (h *uptimeHistory) ratio(now time.Time, days int) (float64, bool) {
+	today := dayNumber(now)
+
+	var up, total int
+
+	for _, slot := range h.days {
+		if slot.total == 0 || slot.day > today || slot.day <= today-int64(days) {
+			continue
+		}
+
+		up += slot.up
+		total += slot.total
+	}
+
+	if total == 0 {
+		return 0, false
+	}
+
+	return float64(up) / float64(total), true
+}
+
+// Uptime returns the fraction of successful checks of the server over the last days,
+// and false if the server has not been checked in that period.
+func (s *Server) Uptime(days int) (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.uptime.ratio(time.Now(), days)
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/armbian/redirector/db"
@@ -21,8 +23,70 @@ func RandomSequence(n int) string {
 
 var (
 	structTags = []string{"json", "yaml", "maxminddb"}
+
+	sizeUnits = map[string]float64{
+		"":    1,
+		"B":   1,
+		"KB":  1e3,
+		"MB":  1e6,
+		"GB":  1e9,
+		"TB":  1e12,
+		"PB":  1e15,
+		"KIB": 1 << 10,
+		"MIB": 1 << 20,
+		"GIB": 1 << 30,
+		"TIB": 1 << 40,
+		"PIB": 1 << 50,
+	}
 )
 
+// ParseSize parses a human readable size like "500GB" or "1.5 TiB" into bytes.
+// Plain numbers are treated as bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+
+	if i == -1 {
+		i = len(s)
+	}
+
+	value, err := strconv.ParseFloat(s[:i], 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+
+	return int64(value * unit), nil
+}
+
+// FormatSize formats bytes into a human readable size like "1.4 GiB".
+func FormatSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+	value := float64(n)
+	i := 0
+
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
 func GetValue(val any, key string) (any, bool) {
 	// Bypass reflection for known types
 	if strings.HasPrefix(key, "asn") || strings.HasPrefix(key, "city") {